@@ -1,9 +1,9 @@
 package ipdb
 
 import (
-	"reflect"
-	"time"
-	"os"
+	"io"
+	"io/fs"
+	"net/netip"
 )
 
 type BaseStationInfo struct {
@@ -16,102 +16,99 @@ type BaseStationInfo struct {
 }
 
 type BaseStation struct {
-	reader *reader
+	database
 }
 
 func NewBaseStation(name string) (*BaseStation, error) {
+	return OpenBaseStation(name)
+}
+
+func OpenBaseStation(name string, opts ...Option) (*BaseStation, error) {
 
-	r, e := newReader(name, &BaseStationInfo{})
-	if e != nil {
+	db := &BaseStation{}
+	if e := db.open(name, &BaseStationInfo{}, opts); e != nil {
 		return nil, e
 	}
 
-	return &BaseStation{
-		reader: r,
-	}, nil
+	return db, nil
 }
 
-func (db *BaseStation) Reload(name string) error {
-
-	_, err := os.Stat(name)
-	if err != nil {
-		return err
+func NewBaseStationFromBytes(bs []byte) (*BaseStation, error) {
+	db := &BaseStation{}
+	if e := db.openBytes(bs, &BaseStationInfo{}); e != nil {
+		return nil, e
 	}
 
-	reader, err := newReader(name, &BaseStationInfo{})
-	if err != nil {
-		return err
-	}
+	return db, nil
+}
 
-	db.reader = reader
+// OpenBaseStationFS initialize with the file name of fsys, such as an embed.FS
+func OpenBaseStationFS(fsys fs.FS, name string, opts ...Option) (*BaseStation, error) {
+	db := &BaseStation{}
+	if e := db.openFS(fsys, name, &BaseStationInfo{}, opts); e != nil {
+		return nil, e
+	}
 
-	return nil
+	return db, nil
 }
 
-func (db *BaseStation) Find(addr, language string) ([]string, error) {
-	return db.reader.find1(addr, language)
-}
+// OpenBaseStationReader initialize with the file read from r, size bytes or all
+// of r if size is negative
+func OpenBaseStationReader(r io.Reader, size int64, opts ...Option) (*BaseStation, error) {
+	db := &BaseStation{}
+	if e := db.openReader(r, size, &BaseStationInfo{}, opts); e != nil {
+		return nil, e
+	}
 
-func (db *BaseStation) FindMap(addr, language string) (map[string]string, error) {
+	return db, nil
+}
 
-	data, err := db.reader.find1(addr, language)
-	if err != nil {
+// Snapshot returns a BaseStation pinned to the currently loaded build, so that
+// several lookups see the same data even if Reload runs in between.
+// The snapshot can not be reloaded; Close it when done.
+func (db *BaseStation) Snapshot() (*BaseStation, error) {
+	s := &BaseStation{}
+	if err := db.pin(&s.database); err != nil {
 		return nil, err
 	}
-	info := make(map[string]string, len(db.reader.meta.Fields))
-	for k, v := range data {
-		info[db.reader.meta.Fields[k]] = v
-	}
 
-	return info, nil
+	return s, nil
 }
 
 func (db *BaseStation) FindInfo(addr, language string) (*BaseStationInfo, error) {
 
-	data, err := db.reader.FindMap(addr, language)
+	ip, err := parseAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	info := &BaseStationInfo{}
-
-	for k, v := range data {
-		sv := reflect.ValueOf(info).Elem()
-		sfv := sv.FieldByName(db.reader.refType[k])
+	return db.FindInfoAddr(ip, language)
+}
 
-		if !sfv.IsValid() {
-			continue
-		}
-		if !sfv.CanSet() {
-			continue
-		}
+func (db *BaseStation) FindInfoAddr(addr netip.Addr, language string) (*BaseStationInfo, error) {
 
-		sft := sfv.Type()
-		fv := reflect.ValueOf(v)
-		if sft == fv.Type() {
-			sfv.Set(fv)
-		}
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
 	}
+	defer r.release()
 
-	return info, nil
-}
+	buf := r.fieldBuf()
+	defer r.putFieldBuf(buf)
+	data, err := r.findInto(addr, language, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
 
-func (db *BaseStation) IsIPv4() bool {
-	return db.reader.IsIPv4Support()
-}
+	info, _ := decodeInfo[BaseStationInfo](r, data)
 
-func (db *BaseStation) IsIPv6() bool {
-	return db.reader.IsIPv6Support()
+	return info, nil
 }
 
-func (db *BaseStation) Languages() []string {
-	return db.reader.Languages()
+func (db *BaseStation) FindInfoLang(addr string, languages []string) (*BaseStationInfo, error) {
+	return findInfoLang[BaseStationInfo](&db.database, addr, languages)
 }
 
-func (db *BaseStation) Fields() []string {
-	return db.reader.meta.Fields
+func (db *BaseStation) FindAllLanguages(addr string) (map[string]*BaseStationInfo, error) {
+	return findAllLanguages[BaseStationInfo](&db.database, addr)
 }
-
-func (db *BaseStation) BuildTime() time.Time {
-	return db.reader.Build()
-}
\ No newline at end of file
@@ -0,0 +1,353 @@
+package ipdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBuildFields = errors.New("builder needs fields and languages")
+	ErrBuildPrefix = errors.New("invalid prefix")
+	ErrBuildValues = errors.New("values do not match the fields and languages")
+	ErrBuildSize   = errors.New("database too large")
+)
+
+// Builder builds an ipdb file from networks and their field values.
+// A network inserted inside another overrides it, whatever the order of
+// insertion, and inserting a network again replaces its values.
+// Identical records are stored once and sibling networks with the same
+// record are merged.
+//
+// IPv4 networks are stored below ::ffff:0:0/96 where the readers look
+// them up. An IPv6 network containing ::ffff:0:0/96 does not cover the
+// IPv4 space, which holds IPv4 networks only.
+type Builder struct {
+	fields    []string
+	languages []string
+	build     time.Time
+	ipVersion uint16
+
+	root    *buildNode
+	records []string
+	index   map[string]int // record -> index in records
+}
+
+type buildNode struct {
+	child [2]*buildNode
+	// rec is the record of the network ending at the node, -1 if none
+	rec int
+}
+
+// NewBuilder returns a Builder for records of fields, in each of the
+// languages
+func NewBuilder(fields []string, languages ...string) (*Builder, error) {
+	if len(fields) == 0 || len(languages) == 0 {
+		return nil, ErrBuildFields
+	}
+	if err := checkNames(fields); err != nil {
+		return nil, err
+	}
+	if err := checkNames(languages); err != nil {
+		return nil, err
+	}
+
+	return &Builder{
+		fields:    append([]string(nil), fields...),
+		languages: append([]string(nil), languages...),
+		root:      &buildNode{rec: -1},
+		index:     make(map[string]int),
+	}, nil
+}
+
+func checkNames(names []string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name == "" || seen[name] {
+			return fmt.Errorf("%w: empty or duplicate name %q", ErrBuildFields, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// SetBuild sets the build time of the file, the time of writing if unset
+func (b *Builder) SetBuild(t time.Time) {
+	b.build = t
+}
+
+// Insert sets the record of prefix, values holds the fields of every
+// language of the builder
+func (b *Builder) Insert(prefix netip.Prefix, values map[string][]string) error {
+	if !prefix.IsValid() {
+		return ErrBuildPrefix
+	}
+	prefix = prefix.Masked()
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	if addr.Zone() != "" {
+		return fmt.Errorf("%w: %s has a zone", ErrBuildPrefix, prefix)
+	}
+
+	rec, err := b.record(values)
+	if err != nil {
+		return err
+	}
+
+	if addr.Is4() {
+		b.ipVersion |= IPv4
+		bits += 96
+	} else {
+		b.ipVersion |= IPv6
+	}
+	ip := addr.As16()
+
+	node := b.root
+	for i := 0; i < bits; i++ {
+		bit := (ip[i>>3] >> uint(7-i&7)) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &buildNode{rec: -1}
+		}
+		node = node.child[bit]
+	}
+	node.rec = rec
+
+	return nil
+}
+
+// parsePrefix parses a prefix in CIDR notation or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.IndexByte(s, '/') >= 0 {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// InsertCIDR is Insert with the prefix in CIDR notation, a single
+// address is a /32 or /128
+func (b *Builder) InsertCIDR(cidr string, values map[string][]string) error {
+	prefix, err := parsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBuildPrefix, err)
+	}
+
+	return b.Insert(prefix, values)
+}
+
+// record returns the index of the record holding values
+func (b *Builder) record(values map[string][]string) (int, error) {
+	if len(values) != len(b.languages) {
+		return 0, fmt.Errorf("%w: %d languages, want %d", ErrBuildValues, len(values), len(b.languages))
+	}
+
+	var sb strings.Builder
+	for i, language := range b.languages {
+		data, ok := values[language]
+		if !ok {
+			return 0, fmt.Errorf("%w: no values for language %s", ErrBuildValues, language)
+		}
+		if len(data) != len(b.fields) {
+			return 0, fmt.Errorf("%w: %d values for language %s, want %d", ErrBuildValues, len(data), language, len(b.fields))
+		}
+		for j, v := range data {
+			if strings.IndexByte(v, '\t') >= 0 {
+				return 0, fmt.Errorf("%w: tab in field %s", ErrBuildValues, b.fields[j])
+			}
+			if i > 0 || j > 0 {
+				sb.WriteByte('\t')
+			}
+			sb.WriteString(v)
+		}
+	}
+	if sb.Len() > math.MaxUint16 {
+		return 0, fmt.Errorf("%w: record of %d bytes", ErrBuildSize, sb.Len())
+	}
+
+	s := sb.String()
+	rec, ok := b.index[s]
+	if !ok {
+		rec = len(b.records)
+		b.records = append(b.records, s)
+		b.index[s] = rec
+	}
+	return rec, nil
+}
+
+// outNode is a node of the tree as written, a leaf if both children
+// are nil
+type outNode struct {
+	child [2]*outNode
+	// rec is the record of a leaf, -1 for an empty leaf
+	rec int
+	id  int
+}
+
+// mappedBit is bit i of the path of ::ffff:0:0/96
+func mappedBit(i int) byte {
+	if i < 80 {
+		return 0
+	}
+	return 1
+}
+
+// finish resolves the networks below n into the tree as written:
+// records are pushed down to the leaves, the IPv4 root does not inherit
+// IPv6 records, and siblings with the same record are merged
+func (b *Builder) finish(n *buildNode, inherited, depth int, mapped bool) *outNode {
+	if mapped && depth == 96 {
+		inherited = -1
+	}
+	if n == nil {
+		if !mapped || depth >= 96 || inherited < 0 {
+			return &outNode{rec: inherited}
+		}
+		// keep the path to the IPv4 root, so that it stays empty
+		n = &buildNode{rec: -1}
+	}
+
+	rec := inherited
+	if n.rec >= 0 {
+		rec = n.rec
+	}
+	// the root is always a node
+	if depth > 0 && n.child[0] == nil && n.child[1] == nil && !(mapped && depth < 96 && rec >= 0) {
+		return &outNode{rec: rec}
+	}
+
+	out := &outNode{}
+	for bit := 0; bit < 2; bit++ {
+		m := mapped && depth < 96 && byte(bit) == mappedBit(depth)
+		out.child[bit] = b.finish(n.child[bit], rec, depth+1, m)
+	}
+	l, r := out.child[0], out.child[1]
+	if depth > 0 && l.isLeaf() && r.isLeaf() && l.rec == r.rec {
+		return l
+	}
+
+	return out
+}
+
+func (n *outNode) isLeaf() bool {
+	return n.child[0] == nil && n.child[1] == nil
+}
+
+// Bytes returns the ipdb file
+func (b *Builder) Bytes() ([]byte, error) {
+	root := b.finish(b.root, -1, 0, true)
+
+	// number the nodes and lay out the records in the order they are
+	// first reached
+	var nodes []*outNode
+	offsets := make(map[int]int) // record -> offset after the padding
+	size := 0
+	for stack := []*outNode{root}; len(stack) > 0; {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		n.id = len(nodes)
+		nodes = append(nodes, n)
+		for bit := 1; bit >= 0; bit-- {
+			c := n.child[bit]
+			switch {
+			case !c.isLeaf():
+				stack = append(stack, c)
+			case c.rec >= 0:
+				if _, ok := offsets[c.rec]; !ok {
+					offsets[c.rec] = size
+					size += 2 + len(b.records[c.rec])
+				}
+			}
+		}
+	}
+
+	nodeCount := len(nodes)
+	totalSize := nodeCount*8 + 16 + size
+	if nodeCount+16+size > math.MaxUint32 {
+		return nil, ErrBuildSize
+	}
+
+	data := make([]byte, nodeCount*8, totalSize)
+	for _, n := range nodes {
+		for bit, c := range n.child {
+			var ptr int
+			switch {
+			case !c.isLeaf():
+				ptr = c.id
+			case c.rec < 0:
+				ptr = nodeCount
+			default:
+				ptr = nodeCount + 16 + offsets[c.rec]
+			}
+			binary.BigEndian.PutUint32(data[n.id*8+bit*4:], uint32(ptr))
+		}
+	}
+
+	// 16 bytes of padding, an empty leaf resolves to an empty record
+	data = append(data, make([]byte, 16+size)...)
+	body := data[nodeCount*8+16:]
+	for rec, off := range offsets {
+		binary.BigEndian.PutUint16(body[off:], uint16(len(b.records[rec])))
+		copy(body[off+2:], b.records[rec])
+	}
+
+	build := b.build
+	if build.IsZero() {
+		build = time.Now()
+	}
+	languages := make(map[string]int, len(b.languages))
+	for i, language := range b.languages {
+		languages[language] = i * len(b.fields)
+	}
+	meta, err := json.Marshal(MetaData{
+		Build:     build.Unix(),
+		IPVersion: b.ipVersion,
+		Languages: languages,
+		NodeCount: nodeCount,
+		TotalSize: len(data),
+		Fields:    b.fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(4 + len(meta) + len(data))
+	binary.Write(&buf, binary.BigEndian, uint32(len(meta)))
+	buf.Write(meta)
+	buf.Write(data)
+
+	return buf.Bytes(), nil
+}
+
+// WriteTo writes the ipdb file to w
+func (b *Builder) WriteTo(w io.Writer) (int64, error) {
+	body, err := b.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(body)
+	return int64(n), err
+}
+
+// Save writes the ipdb file to name
+func (b *Builder) Save(name string) error {
+	body, err := b.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, body, 0644)
+}
@@ -0,0 +1,215 @@
+package ipdb
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func builderValues(cn, en string) map[string][]string {
+	return map[string][]string{"CN": {cn, cn + "市"}, "EN": {en, en + " city"}}
+}
+
+// testNetworks maps the networks of a test database to their values by
+// language
+type testNetworks map[string]map[string][]string
+
+// buildBytes returns an ipdb file with fields and languages, only CN if
+// none, holding networks and built at 3000
+func buildBytes(t testing.TB, fields []string, networks testNetworks, languages ...string) []byte {
+	if len(languages) == 0 {
+		languages = []string{"CN"}
+	}
+	b, err := NewBuilder(fields, languages...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetBuild(time.Unix(3000, 0))
+	for cidr, values := range networks {
+		if err := b.InsertCIDR(cidr, values); err != nil {
+			t.Fatal(cidr, err)
+		}
+	}
+	body, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// buildCity is buildBytes loaded as a City
+func buildCity(t testing.TB, fields []string, networks testNetworks, languages ...string) *City {
+	cdb, err := NewCityFromBytes(buildBytes(t, fields, networks, languages...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cdb
+}
+
+func TestBuilder(t *testing.T) {
+	b, err := NewBuilder([]string{"country_name", "city_name"}, "CN", "EN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetBuild(time.Unix(1700000000, 0))
+
+	// the more specific network wins whatever the order
+	for _, c := range []struct {
+		cidr   string
+		cn, en string
+	}{
+		{"1.2.3.0/24", "乙", "B"},
+		{"1.0.0.0/8", "甲", "A"},
+		{"0.0.0.0/0", "", ""},
+		{"2001:db8::/32", "丙", "C"},
+		{"::/0", "丁", "D"},
+		{"10.0.0.1", "甲", "A"},
+		{"::ffff:192.168.0.0/112", "戊", "E"},
+	} {
+		if err := b.InsertCIDR(c.cidr, builderValues(c.cn, c.en)); err != nil {
+			t.Fatal(c.cidr, err)
+		}
+	}
+
+	body, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb, err := NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cdb.IsIPv4() || !cdb.IsIPv6() || cdb.BuildTime().Unix() != 1700000000 {
+		t.Fatalf("meta = %+v", cdb.Languages())
+	}
+
+	for addr, want := range map[string]string{
+		"1.2.3.4":     "B",
+		"1.2.4.1":     "A",
+		"1.255.0.0":   "A",
+		"10.0.0.1":    "A",
+		"10.0.0.2":    "",
+		"8.8.8.8":     "",
+		"192.168.1.1": "E",
+		"2001:db8::1": "C",
+		"2400:cb00::": "D",
+	} {
+		res, err := cdb.FindMap(addr, "EN")
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		if res["country_name"] != want {
+			t.Errorf("FindMap(%s) = %v, want %s", addr, res, want)
+		}
+	}
+
+	res, err := cdb.FindWithNetwork("1.2.3.4", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Prefix != netip.MustParsePrefix("1.2.3.0/24") || res.Record[1] != "乙市" {
+		t.Fatalf("FindWithNetwork = %+v", res)
+	}
+
+	report, err := cdb.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Records != 6 || report.ReachableNodes != report.NodeCount {
+		t.Fatalf("Verify = %+v", report)
+	}
+}
+
+func TestBuilder_RoundTrip(t *testing.T) {
+	r := db.current()
+	b, err := NewBuilder(r.meta.Fields, "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetBuild(r.Build())
+
+	var prefixes []netip.Prefix
+	mapped := netip.MustParseAddr("::ffff:0.0.0.0").As16()
+	w := r.walkLeaves(r.v4offset, mapped, 96)
+	for {
+		leaf, prefix, ok := w.next()
+		if !ok {
+			break
+		}
+		body, err := r.resolve(leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := r.fieldsInto(leaf, body, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Insert(prefix, map[string][]string{"CN": data}); err != nil {
+			t.Fatal(err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	body, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb, err := NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cdb.current().nodeCount > r.nodeCount {
+		t.Fatalf("node_count %d, original %d", cdb.current().nodeCount, r.nodeCount)
+	}
+
+	for _, prefix := range prefixes {
+		want, err := db.FindWithNetwork(prefix.Addr().String(), "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cdb.FindWithNetwork(prefix.Addr().String(), "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Prefix != want.Prefix || len(got.Record) != len(want.Record) || got.Record[2] != want.Record[2] {
+			t.Fatalf("%s: %+v, original %+v", prefix, got, want)
+		}
+	}
+}
+
+func TestBuilder_Errors(t *testing.T) {
+	if _, err := NewBuilder(nil, "CN"); !errors.Is(err, ErrBuildFields) {
+		t.Fatalf("NewBuilder without fields = %v", err)
+	}
+	if _, err := NewBuilder([]string{"a", "a"}, "CN"); !errors.Is(err, ErrBuildFields) {
+		t.Fatalf("NewBuilder with duplicate fields = %v", err)
+	}
+
+	b, err := NewBuilder([]string{"country_name"}, "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []map[string][]string{
+		{"EN": {"China"}},
+		{"CN": {"中国", "北京"}},
+		{"CN": {"中\t国"}},
+		{"CN": {"中国"}, "EN": {"China"}},
+	} {
+		if err := b.InsertCIDR("1.0.0.0/8", v); !errors.Is(err, ErrBuildValues) {
+			t.Errorf("Insert(%v) = %v, want ErrBuildValues", v, err)
+		}
+	}
+	if err := b.InsertCIDR("1.0.0.0/33", map[string][]string{"CN": {"中国"}}); !errors.Is(err, ErrBuildPrefix) {
+		t.Errorf("Insert(1.0.0.0/33) = %v, want ErrBuildPrefix", err)
+	}
+
+	// an empty builder still loads
+	body, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCityFromBytes(body); err != nil {
+		t.Fatal(err)
+	}
+}
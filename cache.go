@@ -0,0 +1,56 @@
+package ipdb
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync/atomic"
+)
+
+// lookupCache caches search tree walks by address. It is direct mapped:
+// an address has a single slot, chosen by its hash, and a new address
+// replaces whatever the slot held. Slots hold immutable entries swapped
+// atomically, so neither reads nor writes take a lock.
+type lookupCache struct {
+	mask  uint64
+	slots []atomic.Pointer[cacheEntry]
+}
+
+type cacheEntry struct {
+	addr   netip.Addr
+	leaf   int
+	body   []byte
+	prefix netip.Prefix
+}
+
+// newLookupCache returns a cache of size slots, rounded up to a power
+// of two
+func newLookupCache(size int) *lookupCache {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &lookupCache{mask: uint64(n - 1), slots: make([]atomic.Pointer[cacheEntry], n)}
+}
+
+func (c *lookupCache) slot(addr netip.Addr) *atomic.Pointer[cacheEntry] {
+	b := addr.As16()
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	// multiplicative hashing, the high bits are the best mixed
+	h := (hi*0x9E3779B97F4A7C15 ^ lo) * 0xC2B2AE3D27D4EB4F
+	return &c.slots[(h>>32^h)&c.mask]
+}
+
+// get returns the leaf, record and network of addr if they are cached
+func (c *lookupCache) get(addr netip.Addr) (int, []byte, netip.Prefix, bool) {
+	e := c.slot(addr).Load()
+	if e == nil || e.addr != addr {
+		return -1, nil, netip.Prefix{}, false
+	}
+
+	return e.leaf, e.body, e.prefix, true
+}
+
+// add caches the leaf, record and network of addr in its slot
+func (c *lookupCache) add(addr netip.Addr, leaf int, body []byte, prefix netip.Prefix) {
+	c.slot(addr).Store(&cacheEntry{addr: addr, leaf: leaf, body: body, prefix: prefix})
+}
@@ -1,9 +1,12 @@
 package ipdb
 
 import (
-	"encoding/json"
-	"os"
-	"reflect"
+	"io"
+	"io/fs"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -45,6 +48,95 @@ type CityInfo struct {
 	AreaCode string `json:"area_code"`
 
 	UsageType string `json:"usage_type"`
+
+	// Extra holds the database fields CityInfo has no field for
+	Extra map[string]string `json:"extra,omitempty" ipdb:",extra"`
+}
+
+// Coordinates returns Latitude and Longitude as numbers, ok is false
+// if either is missing, malformed or out of range
+func (info *CityInfo) Coordinates() (lat, lon float64, ok bool) {
+	lat, err := strconv.ParseFloat(info.Latitude, 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lon, err = strconv.ParseFloat(info.Longitude, 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+
+	return lat, lon, true
+}
+
+// IsEuropeanUnion whether the country is a member of the European Union
+func (info *CityInfo) IsEuropeanUnion() bool {
+	return info.EuropeanUnion == "1"
+}
+
+// IsAnycast whether the address is announced by anycast
+func (info *CityInfo) IsAnycast() bool {
+	return info.Anycast != "" && info.Anycast != "0"
+}
+
+var locations sync.Map // time zone name -> *time.Location
+
+// Location returns the time zone of Timezone, such as Asia/Shanghai
+func (info *CityInfo) Location() (*time.Location, error) {
+	if info.Timezone == "" {
+		return nil, ErrDataNotExists
+	}
+	if loc, ok := locations.Load(info.Timezone); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(info.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(info.Timezone, loc)
+
+	return loc, nil
+}
+
+// UTCOffsetDuration returns UtcOffset as a duration east of UTC. It
+// accepts the forms UTC+8, UTC-3:30, +08:00, +0800 and 8; ok is false
+// if the value is missing or malformed.
+func (info *CityInfo) UTCOffsetDuration() (time.Duration, bool) {
+	v := strings.TrimSpace(info.UtcOffset)
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "UTC"), "GMT")
+	if v == "" {
+		return 0, false
+	}
+
+	sign := time.Duration(1)
+	switch v[0] {
+	case '-':
+		sign = -1
+		v = v[1:]
+	case '+':
+		v = v[1:]
+	}
+
+	hours, minutes := v, ""
+	if i := strings.IndexByte(v, ':'); i >= 0 {
+		hours, minutes = v[:i], v[i+1:]
+	} else if len(v) == 4 {
+		hours, minutes = v[:2], v[2:]
+	}
+
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 14 {
+		return 0, false
+	}
+	m := 0
+	if minutes != "" {
+		m, err = strconv.Atoi(minutes)
+		if err != nil || m < 0 || m > 59 {
+			return 0, false
+		}
+	}
+
+	return sign * (time.Duration(h)*time.Hour + time.Duration(m)*time.Minute), true
 }
 
 type ASNInfo struct {
@@ -59,137 +151,133 @@ type ASNInfo struct {
 
 // City struct 
 type City struct {
-	reader *reader
+	database
 }
 
 // NewCity initialize
 func NewCity(name string) (*City, error) {
+	return OpenCity(name)
+}
 
-	r, e := newReader(name, &CityInfo{})
-	if e != nil {
+// OpenCity initialize with options, e.g. WithMmap
+func OpenCity(name string, opts ...Option) (*City, error) {
+
+	db := &City{}
+	if e := db.open(name, &CityInfo{}, opts); e != nil {
 		return nil, e
 	}
 
-	return &City{
-		reader: r,
-	}, nil
+	return db, nil
 }
 
 func NewCityFromBytes(bs []byte) (*City, error) {
-	r, e := newReaderFromBytes(bs, &CityInfo{})
-	if e != nil {
+	db := &City{}
+	if e := db.openBytes(bs, &CityInfo{}); e != nil {
 		return nil, e
 	}
 
-	return &City{reader: r}, nil
+	return db, nil
 }
 
-// Reload the database
-func (db *City) Reload(name string) error {
-
-	_, err := os.Stat(name)
-	if err != nil {
-		return err
-	}
-
-	reader, err := newReader(name, &CityInfo{})
-	if err != nil {
-		return err
+// OpenCityFS initialize with the file name of fsys, such as an embed.FS
+func OpenCityFS(fsys fs.FS, name string, opts ...Option) (*City, error) {
+	db := &City{}
+	if e := db.openFS(fsys, name, &CityInfo{}, opts); e != nil {
+		return nil, e
 	}
 
-	db.reader = reader
-
-	return nil
+	return db, nil
 }
 
-// Find query with addr
-func (db *City) Find(addr, language string) ([]string, error) {
-	return db.reader.find1(addr, language)
-}
+// OpenCityReader initialize with the file read from r, size bytes or all
+// of r if size is negative
+func OpenCityReader(r io.Reader, size int64, opts ...Option) (*City, error) {
+	db := &City{}
+	if e := db.openReader(r, size, &CityInfo{}, opts); e != nil {
+		return nil, e
+	}
 
-// FindMap query with addr
-func (db *City) FindMap(addr, language string) (map[string]string, error) {
+	return db, nil
+}
 
-	data, err := db.reader.find1(addr, language)
-	if err != nil {
+// Snapshot returns a City pinned to the currently loaded build, so that
+// several lookups see the same data even if Reload runs in between.
+// The snapshot can not be reloaded; Close it when done.
+func (db *City) Snapshot() (*City, error) {
+	s := &City{}
+	if err := db.pin(&s.database); err != nil {
 		return nil, err
 	}
-	info := make(map[string]string, len(db.reader.meta.Fields))
-	for k, v := range data {
-		info[db.reader.meta.Fields[k]] = v
-	}
 
-	return info, nil
+	return s, nil
 }
 
 // FindInfo query with addr
 func (db *City) FindInfo(addr, language string) (*CityInfo, error) {
 
-	data, err := db.reader.FindMap(addr, language)
+	ip, err := parseAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	var asnInfoList []ASNInfo
-	var asnInfoType = reflect.TypeOf(asnInfoList)
-
-	var districtInfo DistrictInfo
-	var districtInfoType = reflect.TypeOf(districtInfo)
-
-	info := &CityInfo{}
+	return db.FindInfoAddr(ip, language)
+}
 
-	for k, v := range data {
-		sv := reflect.ValueOf(info).Elem()
-		sfv := sv.FieldByName(db.reader.refType[k])
+// FindInfoAddr query with a parsed address
+func (db *City) FindInfoAddr(addr netip.Addr, language string) (*CityInfo, error) {
 
-		if !sfv.IsValid() {
-			continue
-		}
-		if !sfv.CanSet() {
-			continue
-		}
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
 
-		sft := sfv.Type()
-		fv := reflect.ValueOf(v)
-		if sft == fv.Type() {
-			sfv.Set(fv)
-		} else if sft == asnInfoType {
-			err = json.Unmarshal([]byte(v), &asnInfoList)
-			if err == nil {
-				sfv.Set(reflect.ValueOf(asnInfoList))
-			}
-		} else if sft == districtInfoType {
-			err = json.Unmarshal([]byte(v), &districtInfo)
-			if err == nil {
-				sfv.Set(reflect.ValueOf(districtInfo))
-			}
-		}
+	buf := r.fieldBuf()
+	defer r.putFieldBuf(buf)
+	data, err := r.findInto(addr, language, (*buf)[:0])
+	if err != nil {
+		return nil, err
 	}
 
+	info, _ := decodeInfo[CityInfo](r, data)
+
 	return info, nil
 }
 
-// IsIPv4 whether support ipv4
-func (db *City) IsIPv4() bool {
-	return db.reader.IsIPv4Support()
-}
+// FindInfoStrict is FindInfo, but reports values that do not parse, such
+// as malformed asn_info or district_info JSON, as a *FieldError.
+// The returned CityInfo holds every field that did parse.
+func (db *City) FindInfoStrict(addr, language string) (*CityInfo, error) {
 
-// IsIPv6 whether support ipv6
-func (db *City) IsIPv6() bool {
-	return db.reader.IsIPv6Support()
-}
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	buf := r.fieldBuf()
+	defer r.putFieldBuf(buf)
+	data, err := r.findInto(ip, language, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
 
-// Languages return support languages
-func (db *City) Languages() []string {
-	return db.reader.Languages()
+	return decodeInfo[CityInfo](r, data)
 }
 
-// Fields return support fields
-func (db *City) Fields() []string {
-	return db.reader.meta.Fields
+// FindInfoLang query with addr, filling each field from the first of
+// languages that has a non-empty value, e.g. []string{"EN", "CN"}
+func (db *City) FindInfoLang(addr string, languages []string) (*CityInfo, error) {
+	return findInfoLang[CityInfo](&db.database, addr, languages)
 }
 
-// BuildTime return database build Time
-func (db *City) BuildTime() time.Time {
-	return db.reader.Build()
+// FindAllLanguages query with addr once and return the CityInfo of
+// every language the database supports
+func (db *City) FindAllLanguages(addr string) (map[string]*CityInfo, error) {
+	return findAllLanguages[CityInfo](&db.database, addr)
 }
@@ -1,7 +1,14 @@
 package ipdb
 
 import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var db *City
@@ -63,6 +70,22 @@ func BenchmarkCity_Find(b *testing.B) {
 	}
 }
 
+func BenchmarkCity_FindInto(b *testing.B) {
+	b.ReportAllocs()
+	dst := make([]string, 0, 8)
+	for i := 0; i < b.N; i++ {
+		dst, _ = db.FindInto("118.28.1.1", "CN", dst)
+	}
+}
+
+func BenchmarkCity_FindFieldsInto(b *testing.B) {
+	b.ReportAllocs()
+	dst := make([]string, 0, 2)
+	for i := 0; i < b.N; i++ {
+		dst, _ = db.FindFieldsInto("118.28.1.1", "CN", dst, "country_name", "city_name")
+	}
+}
+
 func BenchmarkCity_FindMap(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		db.FindMap("118.28.1.1", "CN")
@@ -74,3 +97,236 @@ func BenchmarkCity_FindInfo(b *testing.B) {
 		db.FindInfo("118.28.1.1", "CN")
 	}
 }
+
+func TestOpenCityMmap(t *testing.T) {
+	mdb, err := OpenCity("city.free.ipdb", WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loc, err := mdb.Find("118.28.1.1", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := db.Find("118.28.1.1", "CN")
+	if strings.Join(loc, "\t") != strings.Join(want, "\t") {
+		t.Fatalf("Find = %v, want %v", loc, want)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if _, err := mdb.Find("118.28.1.1", "CN"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := mdb.Reload("city.free.ipdb"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if err := mdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mdb.Find("118.28.1.1", "CN"); err != ErrDatabaseClosed {
+		t.Fatalf("Find after Close = %v, want ErrDatabaseClosed", err)
+	}
+	// the result of a lookup must outlive the mapping
+	if strings.Join(loc, "\t") != strings.Join(want, "\t") {
+		t.Fatalf("result changed after Close: %v", loc)
+	}
+}
+
+func TestCity_FindAddr(t *testing.T) {
+	for _, addr := range []string{"1.1.1.1", "118.28.1.1", "27.190.250.164", "::ffff:118.28.1.1"} {
+		want, err := db.Find(addr, "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := netip.MustParseAddr(addr)
+
+		got, err := db.FindAddr(ip, "CN")
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("FindAddr(%s) = %v, %v, want %v", addr, got, err, want)
+		}
+		got, err = db.FindBytes(net.ParseIP(addr), "CN")
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("FindBytes(%s) = %v, %v, want %v", addr, got, err, want)
+		}
+		b := ip.Unmap().As4()
+		got, err = db.FindUint32(binary.BigEndian.Uint32(b[:]), "CN")
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("FindUint32(%s) = %v, %v, want %v", addr, got, err, want)
+		}
+
+		m, err := db.FindMapAddr(ip, "CN")
+		if err != nil || m["country_name"] != want[0] {
+			t.Errorf("FindMapAddr(%s) = %v, %v", addr, m, err)
+		}
+		info, err := db.FindInfoAddr(ip, "CN")
+		if err != nil || info.CityName != want[2] {
+			t.Errorf("FindInfoAddr(%s) = %+v, %v", addr, info, err)
+		}
+	}
+
+	if _, err := db.FindBytes([]byte{1, 2, 3}, "CN"); err != ErrIPFormat {
+		t.Errorf("FindBytes short = %v, want ErrIPFormat", err)
+	}
+	if _, err := db.FindAddr(netip.MustParseAddr("2001:250::1"), "CN"); err != ErrNoSupportIPv6 {
+		t.Errorf("FindAddr IPv6 = %v, want ErrNoSupportIPv6", err)
+	}
+}
+
+func BenchmarkCity_FindAddr(b *testing.B) {
+	ip := netip.MustParseAddr("118.28.1.1")
+	for i := 0; i < b.N; i++ {
+		db.FindAddr(ip, "CN")
+	}
+}
+
+func TestCity_FindInto(t *testing.T) {
+	want, _ := db.Find("118.28.1.1", "CN")
+
+	dst := make([]string, 0, 8)
+	got, err := db.FindInto("118.28.1.1", "CN", dst)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("FindInto = %v, %v, want %v", got, err, want)
+	}
+
+	got, err = db.FindFields("118.28.1.1", "CN", "city_name", "country_name")
+	if err != nil || !reflect.DeepEqual(got, []string{want[2], want[0]}) {
+		t.Fatalf("FindFields = %v, %v", got, err)
+	}
+	if _, err := db.FindFields("118.28.1.1", "CN", "nope"); err != ErrNoSupportField {
+		t.Fatalf("FindFields unknown field = %v, want ErrNoSupportField", err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		dst, _ = db.FindInto("118.28.1.1", "CN", dst)
+		dst, _ = db.FindFieldsInto("118.28.1.1", "CN", dst, "country_name")
+	})
+	if allocs != 0 {
+		t.Errorf("FindInto allocs = %v, want 0", allocs)
+	}
+}
+
+func TestCity_FindWithNetwork(t *testing.T) {
+	for _, addr := range []string{"1.1.1.1", "118.28.1.1", "27.190.250.164", "::ffff:118.28.1.1"} {
+		res, err := db.FindWithNetwork(addr, "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := netip.MustParseAddr(addr).Unmap()
+		if !res.Prefix.Contains(ip) || res.Prefix != res.Prefix.Masked() {
+			t.Fatalf("%s: prefix %s does not contain the address", addr, res.Prefix)
+		}
+		want, _ := db.Find(addr, "CN")
+		if !reflect.DeepEqual(res.Record, want) {
+			t.Fatalf("%s: record %v, want %v", addr, res.Record, want)
+		}
+
+		// the first and last address of the network share the record
+		first := res.Prefix.Addr()
+		last := first.As4()
+		for i := res.Prefix.Bits(); i < 32; i++ {
+			last[i/8] |= 1 << (7 - i%8)
+		}
+		for _, a := range []netip.Addr{first, netip.AddrFrom4(last)} {
+			r, err := db.FindAddrWithNetwork(a, "CN")
+			if err != nil || r.Prefix != res.Prefix || !reflect.DeepEqual(r.Record, want) {
+				t.Errorf("%s: %s -> %v, %v, want %s", addr, a, r, err, res.Prefix)
+			}
+		}
+		t.Log(res.Prefix, res.Record)
+	}
+}
+
+func TestCityInfo_Typed(t *testing.T) {
+	info := &CityInfo{
+		Latitude:      "39.904989",
+		Longitude:     "116.405285",
+		EuropeanUnion: "0",
+		Anycast:       "ANYCAST",
+		Timezone:      "Asia/Shanghai",
+		UtcOffset:     "UTC+8",
+	}
+
+	lat, lon, ok := info.Coordinates()
+	if !ok || lat != 39.904989 || lon != 116.405285 {
+		t.Errorf("Coordinates = %v, %v, %v", lat, lon, ok)
+	}
+	if info.IsEuropeanUnion() || !info.IsAnycast() {
+		t.Errorf("IsEuropeanUnion = %v, IsAnycast = %v", info.IsEuropeanUnion(), info.IsAnycast())
+	}
+	loc, err := info.Location()
+	if err != nil || loc.String() != "Asia/Shanghai" {
+		t.Errorf("Location = %v, %v", loc, err)
+	}
+
+	for v, want := range map[string]time.Duration{
+		"UTC+8":      8 * time.Hour,
+		"UTC-3:30":   -(3*time.Hour + 30*time.Minute),
+		"+05:45":     5*time.Hour + 45*time.Minute,
+		"-0800":      -8 * time.Hour,
+		"UTC":        0,
+		"8":          8 * time.Hour,
+		"UTC+banana": 0,
+	} {
+		info.UtcOffset = v
+		got, ok := info.UTCOffsetDuration()
+		if got != want || ok != (v != "UTC" && v != "UTC+banana") {
+			t.Errorf("UTCOffsetDuration(%q) = %v, %v, want %v", v, got, ok, want)
+		}
+	}
+
+	info.Latitude = "91"
+	if _, _, ok := info.Coordinates(); ok {
+		t.Error("Coordinates accepted latitude 91")
+	}
+	info.Timezone = "Mars/Olympus_Mons"
+	if _, err := info.Location(); err == nil {
+		t.Error("Location accepted an unknown time zone")
+	}
+}
+
+func TestCity_FindInfoLang(t *testing.T) {
+	cdb, err := NewCityFromBytes(singleRecordDB(t,
+		[]string{"country_name", "city_name", "country_code"},
+		map[string]int{"CN": 0, "EN": 3},
+		"中国\t北京\tCN\tChina\t\t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := cdb.FindInfoLang("1.2.3.4", []string{"EN", "CN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CountryName != "China" || info.CityName != "北京" || info.CountryCode != "CN" {
+		t.Errorf("FindInfoLang = %+v", info)
+	}
+
+	info, err = cdb.FindInfoLang("1.2.3.4", []string{"JP", "CN", "EN"})
+	if err != nil || info.CountryName != "中国" {
+		t.Errorf("FindInfoLang = %+v, %v", info, err)
+	}
+	if _, err := cdb.FindInfoLang("1.2.3.4", []string{"JP"}); err != ErrNoSupportLanguage {
+		t.Errorf("FindInfoLang unsupported = %v, want ErrNoSupportLanguage", err)
+	}
+
+	all, err := cdb.FindAllLanguages("1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["CN"].CityName != "北京" || all["EN"].CountryName != "China" || all["EN"].CityName != "" {
+		t.Errorf("FindAllLanguages = CN %+v, EN %+v", all["CN"], all["EN"])
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ipipdotnet/ipdb-go"
+)
+
+// command 一个子命令
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{"verify", "检查数据库文件结构（搜索树、指针、记录、IPv4覆盖）", runVerify},
+	{"lint", "检查数据质量（经纬度、时区、asn_info、行政区划代码、多语言一致性）", runLint},
+	{"subset", "按语言、字段和国家裁剪数据库，生成更小的文件", runSubset},
+	{"diff", "比较两个数据库，列出记录变化的网段", runDiff},
+	{"convert", "将datx格式的城市数据库转换为ipdb格式", runConvert},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "ipdbtool - IPDB数据库文件工具\n\n")
+	fmt.Fprintf(os.Stderr, "使用方法:\n")
+	fmt.Fprintf(os.Stderr, "  %s <子命令> [参数]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "子命令:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n使用 %s <子命令> -h 查看子命令参数\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			os.Exit(c.run(os.Args[2:]))
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "错误：未知子命令 '%s'\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+// newFlagSet 创建子命令的参数集，用法中附带位置参数说明
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "使用方法: %s %s [参数] %s\n\n参数说明:\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// printJSON 以缩进格式输出JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func runVerify(args []string) int {
+	fs := newFlagSet("verify", "<数据库路径>")
+	asJSON := fs.Bool("json", false, "以JSON格式输出报告")
+	limit := fs.Int("limit", 20, "文本输出时最多显示的问题数量")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	db, err := ipdb.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载数据库失败: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	report, err := db.Verify()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "检查失败: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		if err := printJSON(report); err != nil {
+			fmt.Fprintf(os.Stderr, "输出失败: %v\n", err)
+			return 1
+		}
+	} else {
+		fmt.Printf("节点数量: %d\n", report.NodeCount)
+		fmt.Printf("可达节点: %d\n", report.ReachableNodes)
+		fmt.Printf("空分支: %d\n", report.EmptyBranches)
+		fmt.Printf("记录数量: %d\n", report.Records)
+		if db.IsIPv4() {
+			fmt.Printf("未覆盖IPv4地址: %d\n", report.UncoveredIPv4Addresses)
+		}
+		fmt.Printf("问题数量: %d\n", report.IssueCount)
+
+		for i, issue := range report.Issues {
+			if i == *limit {
+				fmt.Printf("  ... 省略 %d 个问题\n", report.IssueCount-i)
+				break
+			}
+			fmt.Printf("  [%s] %s", issue.Kind, issue.Prefix)
+			if issue.Node >= 0 {
+				fmt.Printf(" 节点=%d", issue.Node)
+			}
+			if issue.Offset >= 0 {
+				fmt.Printf(" 偏移=%d", issue.Offset)
+			}
+			if issue.Detail != "" {
+				fmt.Printf(" %s", issue.Detail)
+			}
+			fmt.Println()
+		}
+
+		if report.OK() {
+			fmt.Println("✅ 数据库结构检查通过")
+		} else {
+			fmt.Println("❌ 数据库结构检查未通过")
+		}
+	}
+
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+func runLint(args []string) int {
+	fs := newFlagSet("lint", "<数据库路径>")
+	asJSON := fs.Bool("json", false, "以JSON格式输出报告")
+	limit := fs.Int("limit", 20, "文本输出时最多显示的问题数量")
+	maxEmpty := fs.Float64("max-empty-country", 1, "country_code为空的记录比例上限，超过时视为未通过")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	db, err := ipdb.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载数据库失败: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	report, err := db.Lint()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "检查失败: %v\n", err)
+		return 1
+	}
+	ok := report.OK() && report.EmptyCountryCodeShare <= *maxEmpty
+
+	if *asJSON {
+		if err := printJSON(report); err != nil {
+			fmt.Fprintf(os.Stderr, "输出失败: %v\n", err)
+			return 1
+		}
+	} else {
+		fmt.Printf("记录数量: %d\n", report.Records)
+		fmt.Printf("检查项: %v\n", report.Checks)
+		for _, f := range db.Fields() {
+			if f == "country_code" {
+				fmt.Printf("country_code为空: %d (%.2f%%)\n", report.EmptyCountryCode, report.EmptyCountryCodeShare*100)
+			}
+		}
+		for _, kind := range report.Checks {
+			fmt.Printf("  %-20s %d条记录有问题\n", kind, report.Counts[kind])
+		}
+		fmt.Printf("问题数量: %d\n", report.IssueCount)
+
+		for i, issue := range report.Issues {
+			if i == *limit {
+				fmt.Printf("  ... 省略 %d 个问题\n", report.IssueCount-i)
+				break
+			}
+			fmt.Printf("  [%s] %s %s", issue.Kind, issue.Prefix, issue.Field)
+			if issue.Language != "" {
+				fmt.Printf(" 语言=%s", issue.Language)
+			}
+			if issue.Value != "" {
+				fmt.Printf(" 值=%q", issue.Value)
+			}
+			if issue.Detail != "" {
+				fmt.Printf(" %s", issue.Detail)
+			}
+			fmt.Println()
+		}
+
+		if ok {
+			fmt.Println("✅ 数据质量检查通过")
+		} else {
+			fmt.Println("❌ 数据质量检查未通过")
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// splitList 解析逗号分隔的参数，空字符串返回nil
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func runSubset(args []string) int {
+	fs := newFlagSet("subset", "<数据库路径>")
+	output := fs.String("o", "", "输出文件路径（必需）")
+	languages := fs.String("languages", "", "保留的语言，逗号分隔，默认全部保留")
+	fields := fs.String("fields", "", "保留的字段，逗号分隔，按此顺序输出，默认全部保留")
+	countries := fs.String("countries", "", "只保留这些国家的记录，逗号分隔，其他网段使用占位记录")
+	countryField := fs.String("country-field", "", "国家字段，默认为country_code，没有时为country_name")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *output == "" {
+		fs.Usage()
+		return 2
+	}
+
+	db, err := ipdb.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载数据库失败: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	b, err := db.Subset(ipdb.SubsetOptions{
+		Languages:    splitList(*languages),
+		Fields:       splitList(*fields),
+		Countries:    splitList(*countries),
+		CountryField: *countryField,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "裁剪失败: %v\n", err)
+		return 1
+	}
+	if err := b.Save(*output); err != nil {
+		fmt.Fprintf(os.Stderr, "保存失败: %v\n", err)
+		return 1
+	}
+
+	return printSize(fs.Arg(0), *output)
+}
+
+// printSize 输出裁剪前后的文件大小和节点数量
+func printSize(src, dst string) int {
+	for _, name := range []string{src, dst} {
+		if code := printFile(name); code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+// printFile 输出一个ipdb文件的大小、节点数量、记录数量、语言和字段
+func printFile(name string) int {
+	info, err := os.Stat(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取文件失败: %v\n", err)
+		return 1
+	}
+	db, err := ipdb.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载数据库失败: %v\n", err)
+		return 1
+	}
+	report, err := db.Verify()
+	db.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "检查失败: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s: %d字节, %d个节点, %d条记录, 语言%v, 字段%v\n",
+		name, info.Size(), report.NodeCount, report.Records, db.Languages(), db.Fields())
+	return 0
+}
+
+// readPrefixes 解析网段列表和网段文件（每行一个网段，#开头为注释），单个IP视为/32或/128
+func readPrefixes(list, file string) ([]netip.Prefix, error) {
+	values := splitList(list)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				values = append(values, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func runDiff(args []string) int {
+	fs := newFlagSet("diff", "<旧数据库路径> <新数据库路径>")
+	asJSON := fs.Bool("json", false, "以JSON格式输出报告")
+	limit := fs.Int("limit", 50, "文本输出时最多显示的变化数量")
+	language := fs.String("language", "", "比较的语言，默认为CN或两个数据库共有的第一个语言")
+	watch := fs.String("watch", "", "只比较这些网段，逗号分隔")
+	watchFile := fs.String("watch-file", "", "只比较文件中的网段，每行一个")
+	countries := fs.String("countries", "", "只报告变化前或变化后属于这些国家的网段，逗号分隔")
+	countryField := fs.String("country-field", "", "国家字段，默认为country_code，没有时为country_name")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	prefixes, err := readPrefixes(*watch, *watchFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "解析网段失败: %v\n", err)
+		return 2
+	}
+
+	var dbs [2]ipdb.Database
+	for i, name := range fs.Args() {
+		db, err := ipdb.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "加载数据库失败: %s: %v\n", name, err)
+			return 2
+		}
+		defer db.Close()
+		dbs[i] = db
+	}
+
+	report, err := ipdb.Diff(dbs[0], dbs[1], ipdb.DiffOptions{
+		Language:     *language,
+		Watch:        prefixes,
+		Countries:    splitList(*countries),
+		CountryField: *countryField,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "比较失败: %v\n", err)
+		return 2
+	}
+
+	if *asJSON {
+		if err := printJSON(report); err != nil {
+			fmt.Fprintf(os.Stderr, "输出失败: %v\n", err)
+			return 2
+		}
+	} else {
+		fmt.Printf("构建时间: %s -> %s\n", dbs[0].BuildTime().Format("2006-01-02 15:04:05"), dbs[1].BuildTime().Format("2006-01-02 15:04:05"))
+		fmt.Printf("语言: %s\n", report.Language)
+		fmt.Printf("比较字段: %v\n", report.Fields)
+		if len(report.FieldsAdded) > 0 {
+			fmt.Printf("新增字段: %v\n", report.FieldsAdded)
+		}
+		if len(report.FieldsRemoved) > 0 {
+			fmt.Printf("删除字段: %v\n", report.FieldsRemoved)
+		}
+		fmt.Printf("变化网段: %d个, IPv4地址: %d个\n", len(report.Changes), report.IPv4Addresses)
+
+		printCounts("按国家统计", report.ByCountry, *limit)
+		printCounts("按字段统计", report.ByField, *limit)
+
+		if len(report.Changes) > 0 {
+			fmt.Println("变化:")
+		}
+		for i, c := range report.Changes {
+			if i == *limit {
+				fmt.Printf("  ... 省略 %d 个网段\n", len(report.Changes)-i)
+				break
+			}
+			fmt.Printf("  %s", c.Prefix)
+			for _, f := range c.Fields {
+				fmt.Printf(" %s: %q -> %q", f.Field, f.Before, f.After)
+			}
+			fmt.Println()
+		}
+	}
+
+	if len(report.Changes) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printCounts 按数量从大到小输出统计，最多输出limit项
+func printCounts(title string, counts map[string]int, limit int) {
+	if len(counts) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Printf("%s:\n", title)
+	for i, k := range keys {
+		if i == limit {
+			fmt.Printf("  ... 省略 %d 项\n", len(keys)-i)
+			break
+		}
+		name := k
+		if name == "" {
+			name = "(空)"
+		}
+		fmt.Printf("  %-20s %d\n", name, counts[k])
+	}
+}
+
+func runConvert(args []string) int {
+	fs := newFlagSet("convert", "<datx文件路径>")
+	output := fs.String("o", "", "输出文件路径（必需）")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *output == "" {
+		fs.Usage()
+		return 2
+	}
+
+	db, err := ipdb.NewDatxCity(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载datx文件失败: %v\n", err)
+		return 1
+	}
+
+	b, err := db.Convert()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "转换失败: %v\n", err)
+		return 1
+	}
+	if err := b.Save(*output); err != nil {
+		fmt.Fprintf(os.Stderr, "保存失败: %v\n", err)
+		return 1
+	}
+
+	return printFile(*output)
+}
@@ -1,7 +1,9 @@
 module nchnroutes-cli
 
-go 1.21
+go 1.22
 
 require github.com/ipipdotnet/ipdb-go v1.0.0
 
+require github.com/klauspost/compress v1.18.0 // indirect
+
 replace github.com/ipipdotnet/ipdb-go => ../../
@@ -80,6 +80,7 @@ func generateConfigs(dbPath, outputDir, iface string, useParallel bool) {
 	if err != nil {
 		log.Fatalf("加载数据库失败: %v", err)
 	}
+	defer extractor.Close()
 
 	meta := extractor.GetMeta()
 	fmt.Printf("数据库信息:\n")
@@ -0,0 +1,214 @@
+package ipdb
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// Names of the sources of a Composite
+const (
+	SourceCity        = "city"
+	SourceIDC         = "idc"
+	SourceBaseStation = "base_station"
+	SourceDistrict    = "district"
+	SourceRisk        = "risk"
+)
+
+var ErrCompositeSource = errors.New("composite needs at most one City, IDC, BaseStation, District and Risk")
+
+// CompositeSource is a database of a Composite and the language to
+// query it in, CN if empty. Risk databases are always queried in CN.
+type CompositeSource struct {
+	DB       Database
+	Language string
+}
+
+// CompositeResult is the combined result of a Composite lookup, parts
+// are nil for the sources the Composite has not or that failed
+type CompositeResult struct {
+	City        *CityInfo        `json:"city,omitempty"`
+	IDC         *IDCInfo         `json:"idc,omitempty"`
+	BaseStation *BaseStationInfo `json:"base_station,omitempty"`
+	District    *DistrictInfo    `json:"district,omitempty"`
+	Risk        *RiskInfo        `json:"risk,omitempty"`
+
+	// Builds holds the build time of the data each part was read from,
+	// by source name
+	Builds map[string]time.Time `json:"builds"`
+	// Errors holds the lookup error of the sources that failed, by
+	// source name; a failing source does not fail the lookup
+	Errors map[string]error `json:"-"`
+}
+
+// Composite queries a City, IDC, BaseStation, District and Risk
+// database, any of them, with a single call
+type Composite struct {
+	city        *City
+	idc         *IDC
+	baseStation *BaseStation
+	district    *District
+	risk        *Risk
+
+	languages map[string]string // source name -> language
+}
+
+// NewComposite returns a Composite over sources, at most one of each
+// database type
+func NewComposite(sources ...CompositeSource) (*Composite, error) {
+	c := &Composite{languages: make(map[string]string, len(sources))}
+	for _, s := range sources {
+		var name string
+		var dup bool
+		switch db := s.DB.(type) {
+		case *City:
+			name, dup, c.city = SourceCity, c.city != nil, db
+		case *IDC:
+			name, dup, c.idc = SourceIDC, c.idc != nil, db
+		case *BaseStation:
+			name, dup, c.baseStation = SourceBaseStation, c.baseStation != nil, db
+		case *District:
+			name, dup, c.district = SourceDistrict, c.district != nil, db
+		case *Risk:
+			name, dup, c.risk = SourceRisk, c.risk != nil, db
+		default:
+			return nil, ErrCompositeSource
+		}
+		if dup {
+			return nil, ErrCompositeSource
+		}
+
+		language := s.Language
+		if language == "" || name == SourceRisk {
+			language = "CN"
+		}
+		c.languages[name] = language
+	}
+
+	return c, nil
+}
+
+// Find query with addr in every source
+func (c *Composite) Find(addr string) (*CompositeResult, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.FindAddr(ip), nil
+}
+
+// FindAddr is Find with a parsed address
+func (c *Composite) FindAddr(addr netip.Addr) *CompositeResult {
+	res := &CompositeResult{Builds: make(map[string]time.Time, len(c.languages))}
+
+	if c.city != nil {
+		res.City = compositeFind[CityInfo](res, SourceCity, &c.city.database, addr, c.languages[SourceCity])
+	}
+	if c.idc != nil {
+		res.IDC = compositeFind[IDCInfo](res, SourceIDC, &c.idc.database, addr, c.languages[SourceIDC])
+	}
+	if c.baseStation != nil {
+		res.BaseStation = compositeFind[BaseStationInfo](res, SourceBaseStation, &c.baseStation.database, addr, c.languages[SourceBaseStation])
+	}
+	if c.district != nil {
+		res.District = compositeFind[DistrictInfo](res, SourceDistrict, &c.district.database, addr, c.languages[SourceDistrict])
+	}
+	if c.risk != nil {
+		res.Risk = compositeFind[RiskInfo](res, SourceRisk, &c.risk.database, addr, c.languages[SourceRisk])
+	}
+
+	return res
+}
+
+// compositeFind decodes the record of addr in db and records the build
+// time of the data it was read from, or the error
+func compositeFind[T any](res *CompositeResult, name string, db *database, addr netip.Addr, language string) *T {
+	r, err := db.acquire()
+	if err != nil {
+		res.addError(name, err)
+		return nil
+	}
+	defer r.release()
+
+	res.Builds[name] = r.Build()
+
+	buf := r.fieldBuf()
+	defer r.putFieldBuf(buf)
+	data, err := r.findInto(addr, language, (*buf)[:0])
+	if err != nil {
+		res.addError(name, err)
+		return nil
+	}
+
+	info, _ := decodeInfo[T](r, data)
+	return info
+}
+
+func (res *CompositeResult) addError(name string, err error) {
+	if res.Errors == nil {
+		res.Errors = make(map[string]error)
+	}
+	res.Errors[name] = err
+}
+
+// Snapshot returns a Composite over snapshots of every source, so that
+// several lookups see the same builds even if a source is reloaded in
+// between. Close it when done.
+func (c *Composite) Snapshot() (*Composite, error) {
+	s := &Composite{languages: c.languages}
+	var err error
+	if c.city != nil && err == nil {
+		s.city, err = c.city.Snapshot()
+	}
+	if c.idc != nil && err == nil {
+		s.idc, err = c.idc.Snapshot()
+	}
+	if c.baseStation != nil && err == nil {
+		s.baseStation, err = c.baseStation.Snapshot()
+	}
+	if c.district != nil && err == nil {
+		s.district, err = c.district.Snapshot()
+	}
+	if c.risk != nil && err == nil {
+		s.risk, err = c.risk.Snapshot()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Sources returns the databases of the Composite by source name
+func (c *Composite) Sources() map[string]Database {
+	sources := make(map[string]Database, 5)
+	if c.city != nil {
+		sources[SourceCity] = c.city
+	}
+	if c.idc != nil {
+		sources[SourceIDC] = c.idc
+	}
+	if c.baseStation != nil {
+		sources[SourceBaseStation] = c.baseStation
+	}
+	if c.district != nil {
+		sources[SourceDistrict] = c.district
+	}
+	if c.risk != nil {
+		sources[SourceRisk] = c.risk
+	}
+	return sources
+}
+
+// Close closes every source, returning the first error
+func (c *Composite) Close() error {
+	var first error
+	for _, db := range c.Sources() {
+		if err := db.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,76 @@
+package ipdb
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestComposite(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+	cdb, err := NewCity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idc, err := NewIDCFromBytes(buildBytes(t, []string{"country_name", "idc"}, testNetworks{"118.28.0.0/16": {"CN": {"中国", "IDC"}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	risk, err := NewRiskFromBytes(buildBytes(t, []string{"score", "behavior", "country_code"}, testNetworks{"0.0.0.0/0": {"CN": {"80", "proxy", "CN"}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewComposite(CompositeSource{DB: cdb}, CompositeSource{DB: idc}, CompositeSource{DB: risk, Language: "EN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := NewComposite(CompositeSource{DB: cdb}, CompositeSource{DB: cdb}); err != ErrCompositeSource {
+		t.Fatalf("NewComposite with two cities = %v", err)
+	}
+
+	res, err := c.Find("118.28.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.City == nil || res.City.CountryName != "中国" || res.IDC == nil || res.IDC.IDC != "IDC" ||
+		res.Risk == nil || res.Risk.Score != 80 || res.BaseStation != nil || res.District != nil || len(res.Errors) != 0 {
+		t.Fatalf("Find = %+v", res)
+	}
+	if !res.Builds[SourceCity].Equal(time.Unix(1000, 0)) || !res.Builds[SourceIDC].Equal(time.Unix(3000, 0)) {
+		t.Fatalf("Builds = %v", res.Builds)
+	}
+
+	res, err = c.Find("2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.City != nil || res.Errors[SourceCity] != ErrNoSupportIPv6 {
+		t.Fatalf("Find IPv6 = %+v", res)
+	}
+
+	// a snapshot keeps the builds of every source across reloads
+	snap, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, name, cityCopy(t, 2000))
+	if err := cdb.Reload(name); err != nil {
+		t.Fatal(err)
+	}
+	if res := snap.FindAddr(netip.MustParseAddr("118.28.1.1")); !res.Builds[SourceCity].Equal(time.Unix(1000, 0)) {
+		t.Errorf("snapshot Builds = %v", res.Builds)
+	}
+	if res, _ := c.Find("118.28.1.1"); !res.Builds[SourceCity].Equal(time.Unix(2000, 0)) {
+		t.Errorf("Builds after Reload = %v", res.Builds)
+	}
+	snap.Close()
+	if _, err := cdb.Find("118.28.1.1", "CN"); err != nil {
+		t.Fatal(err)
+	}
+}
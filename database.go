@@ -0,0 +1,418 @@
+package ipdb
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// database is the loaded file shared by every database type.
+// The current reader is swapped atomically by Reload; lookups and
+// snapshots hold a reference on the reader they started with, so its
+// content is only released once nobody uses it any more.
+type database struct {
+	cur atomic.Pointer[reader]
+
+	obj  interface{}
+	opts options
+
+	// snapshot is set on handles returned by Snapshot
+	snapshot bool
+
+	// watchers are the running Watchers, stopped by Close
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+func (db *database) open(name string, obj interface{}, opts []Option) error {
+	db.obj = obj
+	db.opts = newOptions(opts)
+
+	r, err := newReader(name, obj, db.opts)
+	if err != nil {
+		return err
+	}
+	db.cur.Store(r)
+
+	return nil
+}
+
+func (db *database) openBytes(bs []byte, obj interface{}) error {
+	db.obj = obj
+	db.opts = newOptions(nil)
+
+	r, err := newReaderFromBytes(bs, obj)
+	if err != nil {
+		return err
+	}
+	if r, err = db.opts.load(r, obj); err != nil {
+		return err
+	}
+	db.cur.Store(r)
+
+	return nil
+}
+
+// acquirer is implemented by the database types, whose lookups can all
+// be served from one reader
+type acquirer interface {
+	acquire() (*reader, error)
+}
+
+// acquire returns the current reader with a reference held on it,
+// the caller must release it when done
+func (db *database) acquire() (*reader, error) {
+	for {
+		r := db.cur.Load()
+		if r.retain() {
+			return r, nil
+		}
+		// a reader that can not be retained is either closed, or was
+		// replaced by Reload between the load and the retain
+		if db.cur.Load() == r {
+			return nil, ErrDatabaseClosed
+		}
+	}
+}
+
+// current returns the current reader without a reference, only its
+// metadata may be used
+func (db *database) current() *reader {
+	return db.cur.Load()
+}
+
+// pin makes dst a snapshot of the reader currently loaded in db
+func (db *database) pin(dst *database) error {
+	r, err := db.acquire()
+	if err != nil {
+		return err
+	}
+
+	dst.obj = db.obj
+	dst.opts = db.opts
+	dst.snapshot = true
+	dst.cur.Store(r)
+
+	return nil
+}
+
+// swap installs r as the current reader and drops the handle's
+// reference on the previous one. A closed database is not revived:
+// r is released and ErrDatabaseClosed returned.
+func (db *database) swap(r *reader) error {
+	for {
+		old := db.current()
+		if old.closed {
+			r.close()
+			return ErrDatabaseClosed
+		}
+		if db.cur.CompareAndSwap(old, r) {
+			old.release()
+			return nil
+		}
+	}
+}
+
+// Reload the database.
+// The new file is validated completely before it replaces the loaded
+// one; on error the loaded database stays in use. Lookups running
+// during Reload finish on the database they started with.
+func (db *database) Reload(name string) error {
+
+	if db.snapshot {
+		return ErrSnapshotReload
+	}
+
+	_, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	reader, err := newReader(name, db.obj, db.opts)
+	if err != nil {
+		return err
+	}
+
+	return db.replace(reader)
+}
+
+// Close releases the database content, unmapping the file if it was
+// opened WithMmap, once in-flight lookups and snapshots are done with it.
+// It also stops the database's Watchers without waiting for them.
+// Lookups, Reload and Watch after Close return ErrDatabaseClosed.
+func (db *database) Close() error {
+	for {
+		old := db.current()
+		if old.closed {
+			return nil
+		}
+
+		// keep the metadata around so Fields, BuildTime etc. still answer
+		tomb := &reader{meta: old.meta, closed: true}
+		if db.cur.CompareAndSwap(old, tomb) {
+			old.release()
+			break
+		}
+	}
+
+	db.mu.Lock()
+	for w := range db.watchers {
+		w.halt()
+	}
+	db.mu.Unlock()
+
+	return nil
+}
+
+// Find query with addr
+func (db *database) Find(addr, language string) ([]string, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.find1(addr, language)
+}
+
+// FindMap query with addr
+func (db *database) FindMap(addr, language string) (map[string]string, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.FindMap(addr, language)
+}
+
+// FindInto query with addr, appending the fields to dst[:0].
+// It does not allocate if dst has room for all fields and the database
+// is not mapped; the strings share memory with the database.
+func (db *database) FindInto(addr, language string, dst []string) ([]string, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.findInto(ip, language, dst)
+}
+
+// FindFields query with addr, returning only the named fields in the
+// order given
+func (db *database) FindFields(addr, language string, fields ...string) ([]string, error) {
+	return db.FindFieldsInto(addr, language, make([]string, 0, len(fields)), fields...)
+}
+
+// FindFieldsInto is FindFields appending to dst[:0], it does not
+// allocate under the same conditions as FindInto
+func (db *database) FindFieldsInto(addr, language string, dst []string, fields ...string) ([]string, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.findFieldsInto(ip, language, dst, fields)
+}
+
+// FindAddr query with a parsed address
+func (db *database) FindAddr(addr netip.Addr, language string) ([]string, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.find1Addr(addr, language)
+}
+
+// FindMapAddr query with a parsed address
+func (db *database) FindMapAddr(addr netip.Addr, language string) (map[string]string, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.findMapAddr(addr, language)
+}
+
+// FindWithNetwork query with addr, also returning the network the
+// record applies to
+func (db *database) FindWithNetwork(addr, language string) (LookupResult, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return LookupResult{}, err
+	}
+
+	return db.FindAddrWithNetwork(ip, language)
+}
+
+// FindAddrWithNetwork is FindWithNetwork with a parsed address
+func (db *database) FindAddrWithNetwork(addr netip.Addr, language string) (LookupResult, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return LookupResult{}, err
+	}
+	defer r.release()
+
+	return r.findWithNetwork(addr, language)
+}
+
+// FindBytes query with a raw 4 or 16 byte address, e.g. a net.IP
+func (db *database) FindBytes(addr []byte, language string) ([]string, error) {
+	ip, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return nil, ErrIPFormat
+	}
+
+	return db.FindAddr(ip, language)
+}
+
+// FindUint32 query with an IPv4 address in host byte order
+func (db *database) FindUint32(addr uint32, language string) ([]string, error) {
+	return db.FindAddr(netip.AddrFrom4([4]byte{
+		byte(addr >> 24), byte(addr >> 16), byte(addr >> 8), byte(addr),
+	}), language)
+}
+
+// Decode queries addr and stores the fields of language into the struct
+// v points to. Struct fields are matched to database fields by their
+// ipdb tag, or else their json tag. string, bool, integer and float
+// fields are parsed from the value; slices, maps, structs and pointers
+// are decoded from JSON. Empty values leave the field untouched. The
+// first value that fails to parse is returned as a *FieldError after the
+// other fields were stored.
+func (db *database) Decode(addr, language string, v interface{}) error {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	return db.DecodeAddr(ip, language, v)
+}
+
+// DecodeAddr is Decode with a parsed address
+func (db *database) DecodeAddr(addr netip.Addr, language string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrDecodeTarget
+	}
+
+	r, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer r.release()
+
+	buf := r.fieldBuf()
+	defer r.putFieldBuf(buf)
+	data, err := r.findInto(addr, language, (*buf)[:0])
+	if err != nil {
+		return err
+	}
+
+	return r.planFor(rv.Elem().Type()).decode(rv.UnsafePointer(), data)
+}
+
+// IsIPv4 whether support ipv4
+func (db *database) IsIPv4() bool {
+	return db.current().IsIPv4Support()
+}
+
+// IsIPv6 whether support ipv6
+func (db *database) IsIPv6() bool {
+	return db.current().IsIPv6Support()
+}
+
+// Languages return support languages
+func (db *database) Languages() []string {
+	return db.current().Languages()
+}
+
+// Fields return support fields
+func (db *database) Fields() []string {
+	return db.current().meta.Fields
+}
+
+// BuildTime return database build Time
+func (db *database) BuildTime() time.Time {
+	return db.current().Build()
+}
+
+// Meta returns a copy of the metadata of the loaded file
+func (db *database) Meta() MetaData {
+	meta := db.current().meta
+	languages := make(map[string]int, len(meta.Languages))
+	for language, off := range meta.Languages {
+		languages[language] = off
+	}
+	meta.Languages = languages
+	meta.Fields = append([]string(nil), meta.Fields...)
+
+	return meta
+}
+
+// findInfoLang is FindInfoLang of the database types with info type T
+func findInfoLang[T any](db *database, addr string, languages []string) (*T, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	data, err := r.findLangs(ip, languages)
+	if err != nil {
+		return nil, err
+	}
+
+	info, _ := decodeInfo[T](r, data)
+	return info, nil
+}
+
+// findAllLanguages is FindAllLanguages of the database types with info
+// type T
+func findAllLanguages[T any](db *database, addr string) (map[string]*T, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	all, err := r.findAllLanguages(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]*T, len(all))
+	for language, data := range all {
+		infos[language], _ = decodeInfo[T](r, data)
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,251 @@
+package ipdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cityCopy returns city.free.ipdb with the build time replaced
+func cityCopy(t testing.TB, build int64) []byte {
+	body, err := os.ReadFile("city.free.ipdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metaLength := int(binary.BigEndian.Uint32(body[0:4]))
+	var meta MetaData
+	if err := json.Unmarshal(body[4:4+metaLength], &meta); err != nil {
+		t.Fatal(err)
+	}
+	meta.Build = build
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]byte, 4, 4+len(mb)+len(body)-4-metaLength)
+	binary.BigEndian.PutUint32(out, uint32(len(mb)))
+	out = append(out, mb...)
+	return append(out, body[4+metaLength:]...)
+}
+
+func writeFile(t testing.TB, name string, body []byte) {
+	if err := os.WriteFile(name, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCitySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+
+	cdb, err := NewCity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+
+	snap, err := cdb.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, name, cityCopy(t, 2000))
+	if err := cdb.Reload(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := snap.BuildTime(); !got.Equal(time.Unix(1000, 0)) {
+		t.Errorf("snapshot BuildTime = %v, want unix 1000", got)
+	}
+	if got := cdb.BuildTime(); !got.Equal(time.Unix(2000, 0)) {
+		t.Errorf("BuildTime = %v, want unix 2000", got)
+	}
+	if _, err := snap.Find("118.28.1.1", "CN"); err != nil {
+		t.Error(err)
+	}
+	if err := snap.Reload(name); err != ErrSnapshotReload {
+		t.Errorf("snapshot Reload = %v, want ErrSnapshotReload", err)
+	}
+
+	snap.Close()
+	if _, err := snap.Find("118.28.1.1", "CN"); err != ErrDatabaseClosed {
+		t.Errorf("Find on closed snapshot = %v, want ErrDatabaseClosed", err)
+	}
+	if _, err := cdb.Find("118.28.1.1", "CN"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCityReloadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+
+	cdb, err := NewCity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+
+	// point the last node of the tree far past the end of the file
+	body := cityCopy(t, 2000)
+	binary.BigEndian.PutUint32(body[4+int(binary.BigEndian.Uint32(body[0:4]))+385082*8:], 0xFFFFFFF0)
+	bad := filepath.Join(dir, "bad.ipdb")
+	writeFile(t, bad, body)
+
+	if err := cdb.Reload(bad); err == nil {
+		t.Fatal("Reload of corrupt file succeeded")
+	}
+	if got := cdb.BuildTime(); !got.Equal(time.Unix(1000, 0)) {
+		t.Errorf("BuildTime = %v, want the old build", got)
+	}
+	if _, err := cdb.Find("118.28.1.1", "CN"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCityReloadConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+
+	cdb, err := OpenCity(name, WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				snap, err := cdb.Snapshot()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := snap.FindInfo("118.28.1.1", "CN"); err != nil {
+					t.Error(err)
+				}
+				snap.Close()
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := cdb.Reload(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// singleRecordDB returns an IPv4 database in which every address has
+// record, the fields of all languages joined by tabs
+func singleRecordDB(t testing.TB, fields []string, languages map[string]int, record string) []byte {
+	const nodeCount = 97
+
+	// nodes 0..95 lead to ::ffff:0:0/96, node 96 is the IPv4 root
+	nodes := make([]byte, nodeCount*8)
+	for i := 0; i < 96; i++ {
+		next, empty := uint32(i+1), uint32(nodeCount)
+		if i < 80 {
+			binary.BigEndian.PutUint32(nodes[i*8:], next)
+			binary.BigEndian.PutUint32(nodes[i*8+4:], empty)
+		} else {
+			binary.BigEndian.PutUint32(nodes[i*8:], empty)
+			binary.BigEndian.PutUint32(nodes[i*8+4:], next)
+		}
+	}
+	// leaves point past 16 bytes of padding after the nodes
+	leaf := uint32(nodeCount + 16)
+	binary.BigEndian.PutUint32(nodes[96*8:], leaf)
+	binary.BigEndian.PutUint32(nodes[96*8+4:], leaf)
+
+	data := append(nodes, make([]byte, 16)...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(record)))
+	data = append(data, record...)
+
+	mb, err := json.Marshal(MetaData{
+		Build:     1000,
+		IPVersion: IPv4,
+		Languages: languages,
+		NodeCount: nodeCount,
+		TotalSize: len(data),
+		Fields:    fields,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(mb)))
+	out = append(out, mb...)
+	return append(out, data...)
+}
+
+func TestFormatError(t *testing.T) {
+	body := cityCopy(t, 1000)
+
+	_, err := NewCityFromBytes(body[:len(body)-1])
+	var fe *FormatError
+	if !errors.Is(err, ErrFileSize) || !errors.As(err, &fe) {
+		t.Fatalf("truncated file: %v", err)
+	}
+
+	_, err = NewCityFromBytes(body[:100])
+	if !errors.Is(err, ErrFileSize) {
+		t.Fatalf("truncated metadata: %v", err)
+	}
+
+	// a leaf pointing past the records is reported with its node
+	orig, err := NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaLength := int(binary.BigEndian.Uint32(body[0:4]))
+	bad := append([]byte(nil), body...)
+	root := 4 + metaLength
+	for i := 0; i < orig.current().meta.NodeCount; i++ {
+		binary.BigEndian.PutUint32(bad[root+i*8:], 0x7FFFFFF0)
+		binary.BigEndian.PutUint32(bad[root+i*8+4:], 0x7FFFFFF0)
+	}
+	cdb, err := NewCityFromBytes(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cdb.Find("1.1.1.1", "CN")
+	if !errors.Is(err, ErrDatabaseError) || !errors.As(err, &fe) || fe.Node != 0x7FFFFFF0 {
+		t.Fatalf("Find on corrupt tree = %v", err)
+	}
+	// so is a record with too few fields, at the offset of the record
+	short := singleRecordDB(t, []string{"score", "behavior", "country_code"}, map[string]int{"CN": 0}, "85\tproxy")
+	rdb, err := NewRiskFromBytes(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rdb.FindInfo("1.2.3.4")
+	if !errors.Is(err, ErrDatabaseError) || !errors.As(err, &fe) {
+		t.Fatalf("FindInfo on short record = %v", err)
+	}
+	metaLength = int(binary.BigEndian.Uint32(short[0:4]))
+	if fe.Node != 97+16 || fe.Offset != 4+metaLength+97*8+16 {
+		t.Fatalf("FindInfo on short record = %+v", fe)
+	}
+}
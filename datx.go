@@ -0,0 +1,340 @@
+package ipdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DatxCityFields are the columns of an IPIP datx city file, in order.
+// Files with fewer columns use the first ones.
+var DatxCityFields = []string{
+	"country_name", "region_name", "city_name", "owner_domain", "isp_domain",
+	"latitude", "longitude", "timezone", "utc_offset", "china_admin_code",
+	"idd_code", "country_code", "continent_code", "idc", "base_station",
+	"country_code3", "european_union", "currency_code", "currency_name", "anycast",
+}
+
+var ErrDatxFormat = errors.New("datx file format error")
+
+// datx layout: a big endian offset, an index of the first entry of
+// every /16, then entries of 9 bytes, the last address of the range
+// (big endian), the offset of its record (3 bytes, little endian) and
+// the length of the record (big endian), then the records
+const (
+	datxPrefixSize = 256 * 256 * 4
+	datxEntrySize  = 9
+)
+
+// DatxCity reads an IPIP datx city file, IPv4 only with a single CN
+// language, with the lookups of City
+type DatxCity struct {
+	entries []byte
+	records []byte
+	count   int
+	prefix  []byte
+	fields  []string
+	build   time.Time
+	plans   sync.Map // reflect.Type -> *decodePlan
+}
+
+// NewDatxCity loads the datx file name. The file has no build time, the
+// time it was modified stands in for it.
+func NewDatxCity(name string) (*DatxCity, error) {
+	body, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := NewDatxCityFromBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	db.build = info.ModTime()
+
+	return db, nil
+}
+
+// NewDatxCityFromBytes loads a datx file from memory, its build time is
+// zero
+func NewDatxCityFromBytes(body []byte) (*DatxCity, error) {
+	if len(body) < 4+datxPrefixSize {
+		return nil, ErrFileSize
+	}
+	end := int(binary.BigEndian.Uint32(body))
+	if end < 4+datxPrefixSize*2 || end-datxPrefixSize > len(body) || (end-4-datxPrefixSize*2)%datxEntrySize != 0 {
+		return nil, fmt.Errorf("%w: index length %d", ErrDatxFormat, end)
+	}
+
+	db := &DatxCity{
+		prefix:  body[4 : 4+datxPrefixSize],
+		entries: body[4+datxPrefixSize : end-datxPrefixSize],
+		records: body[end-datxPrefixSize:],
+	}
+	db.count = len(db.entries) / datxEntrySize
+	if db.count == 0 {
+		return nil, fmt.Errorf("%w: no entries", ErrDatxFormat)
+	}
+	columns, err := db.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	db.fields = make([]string, columns)
+	for i := range db.fields {
+		if i < len(DatxCityFields) {
+			db.fields[i] = DatxCityFields[i]
+		} else {
+			db.fields[i] = fmt.Sprintf("field_%d", i+1)
+		}
+	}
+
+	return db, nil
+}
+
+// validate checks that the index is ordered and the records are inside
+// the file, so that lookups need no bounds checks, and returns the
+// largest number of columns of a record
+func (db *DatxCity) validate() (int, error) {
+	last := 0
+	for x := 0; x < 256*256; x++ {
+		start := int(binary.LittleEndian.Uint32(db.prefix[x*4:]))
+		if start < last || start >= db.count {
+			return 0, fmt.Errorf("%w: index of %d.%d.0.0/16", ErrDatxFormat, x>>8, x&0xff)
+		}
+		last = start
+	}
+
+	columns := 0
+	seen := make(map[int]bool)
+	var prev uint32
+	for i := 0; i < db.count; i++ {
+		e := db.entries[i*datxEntrySize:]
+		ip := binary.BigEndian.Uint32(e)
+		if i > 0 && ip <= prev {
+			return 0, fmt.Errorf("%w: entry %d out of order", ErrDatxFormat, i)
+		}
+		prev = ip
+		off := int(e[4]) | int(e[5])<<8 | int(e[6])<<16
+		if off+int(binary.BigEndian.Uint16(e[7:])) > len(db.records) {
+			return 0, fmt.Errorf("%w: record of entry %d out of range", ErrDatxFormat, i)
+		}
+		if !seen[off] {
+			seen[off] = true
+			if n := strings.Count(string(db.record(i)), "\t") + 1; n > columns {
+				columns = n
+			}
+		}
+	}
+	if prev != 0xffffffff {
+		return 0, fmt.Errorf("%w: entries end at %s", ErrDatxFormat, netip.AddrFrom4([4]byte{byte(prev >> 24), byte(prev >> 16), byte(prev >> 8), byte(prev)}))
+	}
+
+	return columns, nil
+}
+
+// last returns the last address of the range of entry i
+func (db *DatxCity) last(i int) uint32 {
+	return binary.BigEndian.Uint32(db.entries[i*datxEntrySize:])
+}
+
+// record returns the record of entry i
+func (db *DatxCity) record(i int) []byte {
+	e := db.entries[i*datxEntrySize:]
+	off := int(e[4]) | int(e[5])<<8 | int(e[6])<<16
+	return db.records[off : off+int(binary.BigEndian.Uint16(e[7:]))]
+}
+
+// search returns the entry of the range holding ip
+func (db *DatxCity) search(ip uint32) int {
+	x := ip >> 16
+	low := int(binary.LittleEndian.Uint32(db.prefix[x*4:]))
+	high := db.count - 1
+	if x < 256*256-1 {
+		// the range holding the first address of the next /16 may start
+		// in this one
+		high = int(binary.LittleEndian.Uint32(db.prefix[x*4+4:]))
+	}
+
+	return low + sort.Search(high-low, func(i int) bool {
+		return db.last(low+i) >= ip
+	})
+}
+
+func (db *DatxCity) findAddr(addr netip.Addr, language string) ([]string, error) {
+	if language != "CN" {
+		return nil, ErrNoSupportLanguage
+	}
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return nil, ErrNoSupportIPv6
+	}
+	ip := addr.As4()
+
+	data := strings.Split(string(db.record(db.search(binary.BigEndian.Uint32(ip[:])))), "\t")
+	if len(data) < len(db.fields) {
+		data = append(data, make([]string, len(db.fields)-len(data))...)
+	}
+
+	return data[:len(db.fields)], nil
+}
+
+// Find query with addr
+func (db *DatxCity) Find(addr, language string) ([]string, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.findAddr(ip, language)
+}
+
+// FindAddr query with a parsed address
+func (db *DatxCity) FindAddr(addr netip.Addr, language string) ([]string, error) {
+	return db.findAddr(addr, language)
+}
+
+// FindMap query with addr
+func (db *DatxCity) FindMap(addr, language string) (map[string]string, error) {
+	data, err := db.Find(addr, language)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string, len(db.fields))
+	for k, v := range data {
+		info[db.fields[k]] = v
+	}
+
+	return info, nil
+}
+
+// FindInfo query with addr
+func (db *DatxCity) FindInfo(addr, language string) (*CityInfo, error) {
+	info := &CityInfo{}
+	if err := db.Decode(addr, language, info); err != nil {
+		var fe *FieldError
+		if !errors.As(err, &fe) {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// Decode queries addr and decodes its record into the struct pointed to
+// by v; see City.Decode
+func (db *DatxCity) Decode(addr, language string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrDecodeTarget
+	}
+
+	data, err := db.Find(addr, language)
+	if err != nil {
+		return err
+	}
+
+	t := rv.Elem().Type()
+	plan, ok := db.plans.Load(t)
+	if !ok {
+		plan, _ = db.plans.LoadOrStore(t, newDecodePlan(t, db.fields))
+	}
+
+	return plan.(*decodePlan).decode(rv.UnsafePointer(), data)
+}
+
+// IsIPv4 whether support ipv4, always true
+func (db *DatxCity) IsIPv4() bool {
+	return true
+}
+
+// IsIPv6 whether support ipv6, always false
+func (db *DatxCity) IsIPv6() bool {
+	return false
+}
+
+// Languages return support languages, always CN
+func (db *DatxCity) Languages() []string {
+	return []string{"CN"}
+}
+
+// Fields return support fields
+func (db *DatxCity) Fields() []string {
+	return append([]string(nil), db.fields...)
+}
+
+// BuildTime return database build Time
+func (db *DatxCity) BuildTime() time.Time {
+	return db.build
+}
+
+// Convert returns a Builder holding the ranges of the datx file as
+// networks, to write it as an ipdb file with the same fields
+func (db *DatxCity) Convert() (*Builder, error) {
+	b, err := NewBuilder(db.fields, "CN")
+	if err != nil {
+		return nil, err
+	}
+	b.SetBuild(db.build)
+
+	values := make(map[string]map[string][]string) // record -> values
+	var first uint32
+	for i := 0; i < db.count; i++ {
+		last := db.last(i)
+		record := string(db.record(i))
+		v, ok := values[record]
+		if !ok {
+			data := strings.Split(record, "\t")
+			if len(data) < len(db.fields) {
+				data = append(data, make([]string, len(db.fields)-len(data))...)
+			}
+			v = map[string][]string{"CN": data[:len(db.fields)]}
+			values[record] = v
+		}
+
+		for _, p := range rangePrefixes(first, last) {
+			if err := b.Insert(p, v); err != nil {
+				return nil, err
+			}
+		}
+		first = last + 1
+	}
+
+	return b, nil
+}
+
+// rangePrefixes returns the fewest IPv4 networks covering first to last
+func rangePrefixes(first, last uint32) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for lo, hi := uint64(first), uint64(last); lo <= hi; {
+		size := 32
+		if lo > 0 {
+			size = bits.TrailingZeros64(lo)
+			if size > 32 {
+				size = 32
+			}
+		}
+		for lo+(1<<uint(size))-1 > hi {
+			size--
+		}
+		ip := uint32(lo)
+		addr := netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)})
+		prefixes = append(prefixes, netip.PrefixFrom(addr, 32-size))
+		lo += 1 << uint(size)
+	}
+
+	return prefixes
+}
@@ -0,0 +1,175 @@
+package ipdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+type datxRange struct {
+	last   string
+	record string
+}
+
+// datxBytes writes a datx city file holding ranges, which must be in
+// order and end at 255.255.255.255
+func datxBytes(ranges []datxRange) []byte {
+	var entries, records []byte
+	prefix := make([]byte, datxPrefixSize)
+	offsets := make(map[string]int)
+	next := 0 // first /16 without an entry yet
+	for i, r := range ranges {
+		ip := netip.MustParseAddr(r.last).As4()
+		last := binary.BigEndian.Uint32(ip[:])
+		for ; next <= int(last>>16); next++ {
+			binary.LittleEndian.PutUint32(prefix[next*4:], uint32(i))
+		}
+
+		off, ok := offsets[r.record]
+		if !ok {
+			off = len(records)
+			offsets[r.record] = off
+			records = append(records, r.record...)
+		}
+		e := make([]byte, datxEntrySize)
+		binary.BigEndian.PutUint32(e, last)
+		e[4], e[5], e[6] = byte(off), byte(off>>8), byte(off>>16)
+		binary.BigEndian.PutUint16(e[7:], uint16(len(r.record)))
+		entries = append(entries, e...)
+	}
+
+	body := make([]byte, 4, 4+datxPrefixSize+len(entries)+len(records))
+	binary.BigEndian.PutUint32(body, uint32(4+datxPrefixSize+len(entries)+datxPrefixSize))
+	body = append(body, prefix...)
+	body = append(body, entries...)
+	return append(body, records...)
+}
+
+var datxTestRanges = []datxRange{
+	{"0.255.255.255", "保留地址\t保留地址\t"},
+	{"1.0.0.255", "中国\t北京\t北京\t\t\t39.904989\t116.405285"},
+	// spans several /16
+	{"1.2.3.4", "中国\t上海\t上海\t\t\t31.231706\t121.472644"},
+	{"8.8.8.8", "美国\t美国\t"},
+	{"255.255.255.255", "保留地址\t保留地址\t"},
+}
+
+func TestDatxCity(t *testing.T) {
+	db, err := NewDatxCityFromBytes(datxBytes(datxTestRanges))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := db.Fields(); len(fields) != 7 || fields[6] != "longitude" {
+		t.Fatalf("Fields = %v", fields)
+	}
+
+	for addr, want := range map[string]string{
+		"0.0.0.1":         "保留地址",
+		"1.0.0.0":         "北京",
+		"1.0.0.255":       "北京",
+		"1.0.1.0":         "上海",
+		"1.1.200.1":       "上海",
+		"1.2.3.4":         "上海",
+		"1.2.3.5":         "美国",
+		"8.8.8.8":         "美国",
+		"8.8.8.9":         "保留地址",
+		"::ffff:1.1.1.1":  "上海",
+		"255.255.255.255": "保留地址",
+	} {
+		res, err := db.FindMap(addr, "CN")
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		if res["region_name"] != want {
+			t.Errorf("FindMap(%s) = %v, want %s", addr, res, want)
+		}
+	}
+
+	info, err := db.FindInfo("1.1.1.1", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lat, lon, ok := info.Coordinates(); !ok || lat != 31.231706 || lon != 121.472644 {
+		t.Fatalf("FindInfo = %+v", info)
+	}
+
+	if _, err := db.Find("2001:db8::1", "CN"); !errors.Is(err, ErrNoSupportIPv6) {
+		t.Fatalf("Find(IPv6) = %v", err)
+	}
+	if _, err := db.Find("1.1.1.1", "EN"); !errors.Is(err, ErrNoSupportLanguage) {
+		t.Fatalf("Find(EN) = %v", err)
+	}
+
+	body := datxBytes(datxTestRanges[:4])
+	if _, err := NewDatxCityFromBytes(body); !errors.Is(err, ErrDatxFormat) {
+		t.Fatalf("NewDatxCityFromBytes(truncated) = %v", err)
+	}
+}
+
+func TestDatxCity_Convert(t *testing.T) {
+	db, err := NewDatxCityFromBytes(datxBytes(datxTestRanges))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.Convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb, err := NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cdb.IsIPv6() || !equalStrings(cdb.Fields(), db.Fields()) {
+		t.Fatalf("converted fields = %v", cdb.Fields())
+	}
+
+	for _, addr := range []string{"0.0.0.0", "1.0.0.0", "1.0.0.255", "1.0.1.0", "1.2.3.4", "1.2.3.5", "8.8.8.8", "8.8.8.9", "200.1.1.1"} {
+		want, err := db.Find(addr, "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cdb.Find(addr, "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(got, want) {
+			t.Errorf("%s: converted %v, datx %v", addr, got, want)
+		}
+	}
+
+	res, err := cdb.FindWithNetwork("1.2.3.5", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Prefix != netip.MustParsePrefix("1.2.3.5/32") {
+		t.Fatalf("FindWithNetwork(1.2.3.5) = %v", res.Prefix)
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	for _, c := range []struct {
+		first, last string
+		want        []string
+	}{
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"1.0.0.0", "1.0.0.255", []string{"1.0.0.0/24"}},
+		{"1.2.3.5", "1.2.3.8", []string{"1.2.3.5/32", "1.2.3.6/31", "1.2.3.8/32"}},
+		{"255.255.255.255", "255.255.255.255", []string{"255.255.255.255/32"}},
+	} {
+		first, last := netip.MustParseAddr(c.first).As4(), netip.MustParseAddr(c.last).As4()
+		got := rangePrefixes(binary.BigEndian.Uint32(first[:]), binary.BigEndian.Uint32(last[:]))
+		if len(got) != len(c.want) {
+			t.Fatalf("rangePrefixes(%s, %s) = %v", c.first, c.last, got)
+		}
+		for i := range got {
+			if got[i].String() != c.want[i] {
+				t.Errorf("rangePrefixes(%s, %s) = %v", c.first, c.last, got)
+			}
+		}
+	}
+}
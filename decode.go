@@ -0,0 +1,253 @@
+package ipdb
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// FieldError reports a record value that can not be decoded into the
+// struct field it is mapped to
+type FieldError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return "ipdb: decode field " + e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// fieldSetter stores the value of a record field into a struct field
+// at p
+type fieldSetter func(p unsafe.Pointer, v string) error
+
+type fieldDecoder struct {
+	offset uintptr
+	set    fieldSetter
+}
+
+// decodePlan maps the fields of a database to the fields of a struct.
+// It is computed once per struct type when it is first decoded, so
+// decoding a record is a plain indexed assignment.
+type decodePlan struct {
+	names []string
+
+	// fields is indexed like MetaData.Fields, nil entries are skipped
+	fields []*fieldDecoder
+
+	// extra is the offset of the map[string]string field tagged
+	// ipdb:",extra" that collects the fields not mapped to the struct
+	extra    uintptr
+	hasExtra bool
+}
+
+// fieldName returns the database field a struct field is mapped to,
+// from its ipdb tag or else its json tag, and whether it is the field
+// collecting unmapped values
+func fieldName(sf reflect.StructField) (string, bool) {
+	tag, ok := sf.Tag.Lookup("ipdb")
+	if !ok {
+		tag = sf.Tag.Get("json")
+	}
+	extra := false
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		extra = ok && strings.Contains(tag[i:], ",extra")
+		tag = tag[:i]
+	}
+	if tag == "-" {
+		return "", false
+	}
+
+	return tag, extra
+}
+
+func newDecodePlan(t reflect.Type, fields []string) *decodePlan {
+	index := make(map[string]int, len(fields))
+	for i, f := range fields {
+		index[f] = i
+	}
+
+	plan := &decodePlan{names: fields, fields: make([]*fieldDecoder, len(fields))}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, extra := fieldName(sf)
+		if extra && sf.Type == reflect.TypeOf(map[string]string(nil)) {
+			plan.extra, plan.hasExtra = sf.Offset, true
+			continue
+		}
+		k, ok := index[name]
+		if !ok {
+			continue
+		}
+		set := newFieldSetter(sf.Type)
+		if set == nil {
+			continue
+		}
+		plan.fields[k] = &fieldDecoder{offset: sf.Offset, set: set}
+	}
+
+	return plan
+}
+
+// newFieldSetter returns the setter for a field of type t, nil if the
+// type is not supported. Empty values leave the field untouched.
+func newFieldSetter(t reflect.Type) fieldSetter {
+	switch t.Kind() {
+	case reflect.String:
+		return func(p unsafe.Pointer, v string) error {
+			if v != "" {
+				*(*string)(p) = v
+			}
+			return nil
+		}
+	case reflect.Bool:
+		return func(p unsafe.Pointer, v string) error {
+			if v == "" {
+				return nil
+			}
+			b, err := strconv.ParseBool(v)
+			*(*bool)(p) = b
+			return err
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		kind, bits := t.Kind(), t.Bits()
+		return func(p unsafe.Pointer, v string) error {
+			if v == "" {
+				return nil
+			}
+			n, err := strconv.ParseInt(v, 10, bits)
+			switch kind {
+			case reflect.Int:
+				*(*int)(p) = int(n)
+			case reflect.Int8:
+				*(*int8)(p) = int8(n)
+			case reflect.Int16:
+				*(*int16)(p) = int16(n)
+			case reflect.Int32:
+				*(*int32)(p) = int32(n)
+			default:
+				*(*int64)(p) = n
+			}
+			return err
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		kind, bits := t.Kind(), t.Bits()
+		return func(p unsafe.Pointer, v string) error {
+			if v == "" {
+				return nil
+			}
+			n, err := strconv.ParseUint(v, 10, bits)
+			switch kind {
+			case reflect.Uint:
+				*(*uint)(p) = uint(n)
+			case reflect.Uint8:
+				*(*uint8)(p) = uint8(n)
+			case reflect.Uint16:
+				*(*uint16)(p) = uint16(n)
+			case reflect.Uint32:
+				*(*uint32)(p) = uint32(n)
+			default:
+				*(*uint64)(p) = n
+			}
+			return err
+		}
+	case reflect.Float32, reflect.Float64:
+		kind, bits := t.Kind(), t.Bits()
+		return func(p unsafe.Pointer, v string) error {
+			if v == "" {
+				return nil
+			}
+			f, err := strconv.ParseFloat(v, bits)
+			if kind == reflect.Float32 {
+				*(*float32)(p) = float32(f)
+			} else {
+				*(*float64)(p) = f
+			}
+			return err
+		}
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct, reflect.Pointer:
+		// nested JSON such as asn_info and district_info, only stored
+		// if the whole value parses
+		return func(p unsafe.Pointer, v string) error {
+			if v == "" {
+				return nil
+			}
+			tmp := reflect.New(t)
+			if err := json.Unmarshal([]byte(v), tmp.Interface()); err != nil {
+				return err
+			}
+			reflect.NewAt(t, p).Elem().Set(tmp.Elem())
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// decode stores data, the fields of one language of a record, into the
+// struct at dst, which must be of the type the plan was made for
+func (plan *decodePlan) decode(dst unsafe.Pointer, data []string) error {
+	var first error
+	for k, v := range data {
+		fd := plan.fields[k]
+		if fd == nil {
+			if plan.hasExtra {
+				m := (*map[string]string)(unsafe.Add(dst, plan.extra))
+				if *m == nil {
+					*m = make(map[string]string)
+				}
+				(*m)[plan.names[k]] = v
+			}
+			continue
+		}
+		if err := fd.set(unsafe.Add(dst, fd.offset), v); err != nil && first == nil {
+			first = &FieldError{Field: plan.names[k], Value: v, Err: err}
+		}
+	}
+
+	return first
+}
+
+// decodeInfo decodes data into a new T, the returned error is a
+// *FieldError for the first value that did not parse
+func decodeInfo[T any](r *reader, data []string) (*T, error) {
+	info := new(T)
+	err := r.planFor(reflect.TypeOf(info).Elem()).decode(unsafe.Pointer(info), data)
+
+	return info, err
+}
+
+// planFor returns the decode plan of struct type t for the fields of r
+func (r *reader) planFor(t reflect.Type) *decodePlan {
+	if plan, ok := r.plans.Load(t); ok {
+		return plan.(*decodePlan)
+	}
+	plan, _ := r.plans.LoadOrStore(t, newDecodePlan(t, r.meta.Fields))
+
+	return plan.(*decodePlan)
+}
+
+// Decoder is implemented by every database type
+type Decoder interface {
+	Decode(addr, language string, v interface{}) error
+}
+
+// FindAs queries addr and decodes the fields of language into a new T,
+// which must be a struct type. Struct fields are matched to database
+// fields by their ipdb tag, or else their json tag; see Decode.
+func FindAs[T any](db Decoder, addr, language string) (T, error) {
+	var v T
+	err := db.Decode(addr, language, &v)
+
+	return v, err
+}
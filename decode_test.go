@@ -0,0 +1,160 @@
+package ipdb
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+func TestDecodePlan(t *testing.T) {
+	fields := []string{"country_name", "asn_info", "district_info", "unknown", "latitude"}
+	plan := newDecodePlan(reflect.TypeOf(CityInfo{}), fields)
+
+	info := &CityInfo{}
+	err := plan.decode(unsafe.Pointer(info), []string{
+		"中国",
+		`[{"asn":4134,"reg":"apnic","cc":"CN","net":"CHINANET","org":"China Telecom","type":"isp","domain":"chinatelecom.cn"}]`,
+		`{"district_name":"海淀区","china_admin_code":"110108"}`,
+		"vendor value",
+		"39.9",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &CityInfo{
+		CountryName: "中国",
+		Latitude:    "39.9",
+		ASNInfo: []ASNInfo{{
+			ASN: 4134, Registry: "apnic", Country: "CN", Net: "CHINANET",
+			Org: "China Telecom", Type: "isp", Domain: "chinatelecom.cn",
+		}},
+		DistrictInfo: DistrictInfo{DistrictName: "海淀区", ChinaAdminCode: "110108"},
+		Extra:        map[string]string{"unknown": "vendor value"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("decode = %+v, want %+v", info, want)
+	}
+
+	// malformed JSON leaves the field alone and is reported
+	info = &CityInfo{}
+	err = plan.decode(unsafe.Pointer(info), []string{"中国", "[{", "", "", ""})
+	if err == nil || info.ASNInfo != nil || info.CountryName != "中国" {
+		t.Fatalf("decode malformed = %+v, %v", info, err)
+	}
+
+	risk := &RiskInfo{}
+	newDecodePlan(reflect.TypeOf(RiskInfo{}), []string{"score", "behavior"}).
+		decode(unsafe.Pointer(risk), []string{"42", "proxy"})
+	if *risk != (RiskInfo{Score: 42, Behavior: "proxy"}) {
+		t.Fatalf("decode risk = %+v", risk)
+	}
+}
+
+func TestFindAs(t *testing.T) {
+	type location struct {
+		Country string `ipdb:"country_name"`
+		City    string `json:"city_name,omitempty"`
+		Region  string `ipdb:"-" json:"region_name"`
+	}
+
+	loc, err := FindAs[location](db, "118.28.1.1", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := db.Find("118.28.1.1", "CN")
+	if loc.Country != want[0] || loc.City != want[2] || loc.Region != "" {
+		t.Fatalf("FindAs = %+v, want %v", loc, want)
+	}
+
+	if err := db.Decode("118.28.1.1", "CN", loc); err != ErrDecodeTarget {
+		t.Fatalf("Decode into non-pointer = %v, want ErrDecodeTarget", err)
+	}
+}
+
+func TestDecodePlanKinds(t *testing.T) {
+	type record struct {
+		Lat     float64         `ipdb:"latitude"`
+		EU      bool            `ipdb:"european_union"`
+		ASN     uint32          `ipdb:"asn"`
+		Radius  int16           `ipdb:"covering_radius"`
+		Extra   map[string]int  `ipdb:"extra"`
+		Nested  *DistrictInfo   `ipdb:"district_info"`
+		Missing json.RawMessage `ipdb:"missing"`
+	}
+	fields := []string{"latitude", "european_union", "asn", "covering_radius", "extra", "district_info"}
+	plan := newDecodePlan(reflect.TypeOf(record{}), fields)
+
+	var rec record
+	err := plan.decode(unsafe.Pointer(&rec), []string{"39.9", "1", "4134", "", `{"a":1}`, `{"city_name":"北京"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Lat != 39.9 || !rec.EU || rec.ASN != 4134 || rec.Radius != 0 ||
+		rec.Extra["a"] != 1 || rec.Nested == nil || rec.Nested.CityName != "北京" {
+		t.Fatalf("decode = %+v", rec)
+	}
+
+	err = plan.decode(unsafe.Pointer(&rec), []string{"north", "", "", "", "", ""})
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Field != "latitude" || fe.Value != "north" {
+		t.Fatalf("decode malformed = %v", err)
+	}
+}
+
+func TestDecodePlanExtra(t *testing.T) {
+	fields := []string{"country_name", "usage_type", "vendor_score", "asn_info"}
+	plan := newDecodePlan(reflect.TypeOf(CityInfo{}), fields)
+
+	info := &CityInfo{}
+	err := plan.decode(unsafe.Pointer(info), []string{"中国", "isp", "7", "not json"})
+	if info.UsageType != "isp" || !reflect.DeepEqual(info.Extra, map[string]string{"vendor_score": "7"}) {
+		t.Fatalf("decode = %+v", info)
+	}
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Field != "asn_info" {
+		t.Fatalf("decode error = %v, want a FieldError for asn_info", err)
+	}
+}
+
+func TestDecode_ManyFields(t *testing.T) {
+	// more fields than a fixed scratch array would hold
+	fields := []string{"country_name", "region_name", "city_name"}
+	values := []string{"中国", "北京", "北京"}
+	for i := len(fields); i < 40; i++ {
+		fields = append(fields, "extra_"+strconv.Itoa(i))
+		values = append(values, strconv.Itoa(i))
+	}
+	cdb := buildCity(t, fields, testNetworks{"1.0.0.0/8": {"CN": values}})
+
+	var loc struct {
+		City string `ipdb:"city_name"`
+		Last int    `ipdb:"extra_39"`
+	}
+	if err := cdb.Decode("1.2.3.4", "CN", &loc); err != nil || loc.City != "北京" || loc.Last != 39 {
+		t.Fatalf("Decode = %+v, %v", loc, err)
+	}
+	if n := testing.AllocsPerRun(100, func() { cdb.Decode("1.2.3.4", "CN", &loc) }); n != 0 {
+		t.Errorf("Decode allocates %v times", n)
+	}
+}
+
+func TestDecode_EmptyKeepsField(t *testing.T) {
+	cdb := buildCity(t, []string{"country_name", "region_name", "city_name"}, testNetworks{
+		"1.0.0.0/8": {"CN": {"中国", "", ""}},
+	})
+
+	loc := struct {
+		Country string `ipdb:"country_name"`
+		City    string `ipdb:"city_name"`
+	}{Country: "replaced", City: "keep"}
+	if err := cdb.Decode("1.2.3.4", "CN", &loc); err != nil {
+		t.Fatal(err)
+	}
+	if loc.Country != "中国" || loc.City != "keep" {
+		t.Fatalf("Decode = %+v, want the empty city_name to keep City", loc)
+	}
+}
@@ -0,0 +1,419 @@
+package ipdb
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+)
+
+// ErrDiffSource is returned by Diff for a Database not opened by this
+// package
+var ErrDiffSource = errors.New("diff needs databases opened by ipdb")
+
+// DiffOptions selects what Diff compares and reports
+type DiffOptions struct {
+	// Language to compare, CN if both databases have it, else the first
+	// language they have in common
+	Language string
+
+	// Watch restricts the diff to these networks, changes are clipped
+	// to them. No restriction if empty.
+	Watch []netip.Prefix
+
+	// Countries restricts the diff to changes whose CountryField is one
+	// of these before or after. No restriction if empty.
+	Countries []string
+	// CountryField defaults to country_code, or country_name if either
+	// database has no country_code
+	CountryField string
+}
+
+// FieldChange is the before and after value of a field
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// DiffChange is a network whose record changed, every address in it
+// changed the same way
+type DiffChange struct {
+	Prefix netip.Prefix `json:"prefix"`
+	// Country is the value of the country field after the change
+	Country string        `json:"country"`
+	Fields  []FieldChange `json:"fields"`
+}
+
+// DiffReport is the result of Diff
+type DiffReport struct {
+	Language string `json:"language"`
+	// Fields compared, those both databases have
+	Fields        []string `json:"fields"`
+	FieldsAdded   []string `json:"fields_added,omitempty"`
+	FieldsRemoved []string `json:"fields_removed,omitempty"`
+
+	Changes []DiffChange `json:"changes"`
+	// IPv4Addresses is the number of IPv4 addresses whose record changed
+	IPv4Addresses uint64 `json:"ipv4_addresses"`
+
+	// ByCountry counts the changes per country before and after, a
+	// network moved between countries counts for both
+	ByCountry map[string]int `json:"by_country"`
+	// ByField counts the changes per field
+	ByField map[string]int `json:"by_field"`
+}
+
+// Diff walks the databases from and to in lockstep and reports the
+// networks whose record changed, with the fields that changed. Addresses
+// without a record compare as records with empty fields.
+func Diff(from, to Database, opts DiffOptions) (*DiffReport, error) {
+	fa, ok1 := from.(acquirer)
+	ta, ok2 := to.(acquirer)
+	if !ok1 || !ok2 {
+		return nil, ErrDiffSource
+	}
+
+	a, err := fa.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer a.release()
+	b, err := ta.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	d, err := newDiffer(a, b, opts)
+	if err != nil {
+		return nil, err
+	}
+	return d.run()
+}
+
+// diffSide is one of the databases of a diff
+type diffSide struct {
+	r     *reader
+	off   int   // offset of the language
+	index []int // index of each compared field
+	buf   []string
+	cache map[int][]string // leaf -> compared values
+	empty []string
+	// onPath marks the nodes on the path of the walk
+	onPath []bool
+}
+
+// enter marks node as on the path of the walk, a node met again on its
+// own path is a cycle that would be walked until the depth runs out
+func (s *diffSide) enter(node int) error {
+	if s.onPath[node] {
+		return formatError(ErrDatabaseError, s.r.dataOffset+node*8, node, "node reached again below itself")
+	}
+	s.onPath[node] = true
+	return nil
+}
+
+// values returns the compared values of the record of node, a leaf
+func (s *diffSide) values(node int) ([]string, error) {
+	if node == s.r.nodeCount {
+		return s.empty, nil
+	}
+	if v, ok := s.cache[node]; ok {
+		return v, nil
+	}
+
+	body, err := s.r.resolve(node)
+	if err != nil {
+		return nil, err
+	}
+	if s.buf, err = s.r.fieldsInto(node, body, s.off, s.buf); err != nil {
+		return nil, err
+	}
+	v := make([]string, len(s.index))
+	for i, n := range s.index {
+		v[i] = s.buf[n]
+	}
+	s.cache[node] = v
+
+	return v, nil
+}
+
+type differ struct {
+	a, b      diffSide
+	report    *DiffReport
+	watch     []netip.Prefix // in the IPv6 form of the tree
+	country   int            // index in report.Fields, -1 if none
+	countries map[string]bool
+}
+
+func newDiffer(a, b *reader, opts DiffOptions) (*differ, error) {
+	language := opts.Language
+	if language == "" {
+		var common []string
+		for l := range a.meta.Languages {
+			if _, ok := b.meta.Languages[l]; ok {
+				common = append(common, l)
+			}
+		}
+		sort.Strings(common)
+		for _, l := range common {
+			if l == "CN" {
+				language = l
+			}
+		}
+		if language == "" && len(common) > 0 {
+			language = common[0]
+		}
+	}
+	offA, ok1 := a.meta.Languages[language]
+	offB, ok2 := b.meta.Languages[language]
+	if !ok1 || !ok2 {
+		return nil, ErrNoSupportLanguage
+	}
+
+	report := &DiffReport{
+		Language:  language,
+		ByCountry: make(map[string]int),
+		ByField:   make(map[string]int),
+	}
+	d := &differ{
+		a:       diffSide{r: a, off: offA, cache: make(map[int][]string), onPath: make([]bool, a.nodeCount)},
+		b:       diffSide{r: b, off: offB, cache: make(map[int][]string), onPath: make([]bool, b.nodeCount)},
+		report:  report,
+		country: -1,
+	}
+	for _, f := range a.meta.Fields {
+		if n, ok := b.fieldIndex[f]; ok {
+			report.Fields = append(report.Fields, f)
+			d.a.index = append(d.a.index, a.fieldIndex[f])
+			d.b.index = append(d.b.index, n)
+		} else {
+			report.FieldsRemoved = append(report.FieldsRemoved, f)
+		}
+	}
+	for _, f := range b.meta.Fields {
+		if _, ok := a.fieldIndex[f]; !ok {
+			report.FieldsAdded = append(report.FieldsAdded, f)
+		}
+	}
+	d.a.empty = make([]string, len(report.Fields))
+	d.b.empty = d.a.empty
+
+	name := opts.CountryField
+	if name == "" {
+		name = "country_code"
+		if !hasField(report.Fields, name) {
+			name = "country_name"
+		}
+	}
+	for i, f := range report.Fields {
+		if f == name {
+			d.country = i
+		}
+	}
+	if len(opts.Countries) > 0 {
+		if d.country < 0 {
+			return nil, ErrNoSupportField
+		}
+		d.countries = make(map[string]bool, len(opts.Countries))
+		for _, c := range opts.Countries {
+			d.countries[c] = true
+		}
+	}
+
+	for _, p := range opts.Watch {
+		if !p.IsValid() {
+			return nil, ErrIPFormat
+		}
+		p = p.Masked()
+		if p.Addr().Is4() {
+			p = netip.PrefixFrom(netip.AddrFrom16(p.Addr().As16()), p.Bits()+96)
+		}
+		d.watch = append(d.watch, p)
+	}
+	d.watch = collapse(d.watch)
+
+	return d, nil
+}
+
+func (d *differ) run() (*DiffReport, error) {
+	a, b := d.a.r, d.b.r
+
+	if a.IsIPv4Support() || b.IsIPv4Support() {
+		na, nb := a.nodeCount, b.nodeCount
+		if a.IsIPv4Support() {
+			na = a.v4offset
+		}
+		if b.IsIPv4Support() {
+			nb = b.v4offset
+		}
+		if err := d.walk(na, nb, netip.IPv4Unspecified().As16(), 96, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.IsIPv6Support() || b.IsIPv6Support() {
+		na, nb := a.nodeCount, b.nodeCount
+		if a.IsIPv6Support() {
+			na = 0
+		}
+		if b.IsIPv6Support() {
+			nb = 0
+		}
+		if err := d.walk(na, nb, [16]byte{}, 0, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.report, nil
+}
+
+// walk compares the subtrees at node a of the tree of from and node b
+// of the tree of to, reached by the first bits of ip. skip4 skips the IPv4
+// subtree, walked from its own root.
+func (d *differ) walk(a, b int, ip [16]byte, bits int, skip4 bool) error {
+	path := netip.PrefixFrom(netip.AddrFrom16(ip), bits)
+	if skip4 && bits == 96 && path.Addr().Is4In6() {
+		return nil
+	}
+	if len(d.watch) > 0 && !overlapsAny(path, d.watch) {
+		return nil
+	}
+
+	leafA, leafB := a >= d.a.r.nodeCount, b >= d.b.r.nodeCount
+	if (leafA && leafB) || bits >= 128 {
+		return d.compare(a, b, path)
+	}
+	if !leafA {
+		if err := d.a.enter(a); err != nil {
+			return err
+		}
+		defer func() { d.a.onPath[a] = false }()
+	}
+	if !leafB {
+		if err := d.b.enter(b); err != nil {
+			return err
+		}
+		defer func() { d.b.onPath[b] = false }()
+	}
+
+	for bit := 0; bit < 2; bit++ {
+		ca, cb := a, b
+		if !leafA {
+			ca = d.a.r.readNode(a, bit)
+		}
+		if !leafB {
+			cb = d.b.r.readNode(b, bit)
+		}
+		next := ip
+		if bit == 1 {
+			next[bits>>3] |= 0x80 >> uint(bits&7)
+		}
+		if err := d.walk(ca, cb, next, bits+1, skip4); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func overlapsAny(p netip.Prefix, list []netip.Prefix) bool {
+	for _, w := range list {
+		if p.Overlaps(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare reports the leaves a and b if their records differ
+func (d *differ) compare(a, b int, path netip.Prefix) error {
+	before, err := d.a.values(a)
+	if err != nil {
+		return err
+	}
+	after, err := d.b.values(b)
+	if err != nil {
+		return err
+	}
+
+	var fields []FieldChange
+	for i, f := range d.report.Fields {
+		if before[i] != after[i] {
+			fields = append(fields, FieldChange{Field: f, Before: before[i], After: after[i]})
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var country string
+	if d.country >= 0 {
+		country = after[d.country]
+		if d.countries != nil && !d.countries[before[d.country]] && !d.countries[country] {
+			return nil
+		}
+	}
+
+	prefixes := []netip.Prefix{path}
+	if len(d.watch) > 0 {
+		prefixes = clip(path, d.watch)
+	}
+
+	for _, p := range prefixes {
+		p = treePrefix(p.Addr().As16(), p.Bits())
+		d.report.Changes = append(d.report.Changes, DiffChange{Prefix: p, Country: country, Fields: fields})
+		if p.Addr().Is4() {
+			d.report.IPv4Addresses += 1 << uint(32-p.Bits())
+		}
+
+		if d.country >= 0 {
+			d.report.ByCountry[before[d.country]]++
+			if after[d.country] != before[d.country] {
+				d.report.ByCountry[after[d.country]]++
+			}
+		}
+		for _, f := range fields {
+			d.report.ByField[f.Field]++
+		}
+	}
+
+	return nil
+}
+
+// collapse sorts ps and drops the prefixes contained in another one, so
+// that no address is covered twice
+func collapse(ps []netip.Prefix) []netip.Prefix {
+	sort.Slice(ps, func(i, j int) bool {
+		if c := ps[i].Addr().Compare(ps[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return ps[i].Bits() < ps[j].Bits()
+	})
+
+	// a prefix sorts after the one containing it, and the kept ones are
+	// disjoint, so only the last kept one can contain the next
+	var out []netip.Prefix
+	for _, p := range ps {
+		if n := len(out); n > 0 && out[n-1].Contains(p.Addr()) {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// clip returns the parts of p inside the watched networks, which must
+// not overlap
+func clip(p netip.Prefix, watch []netip.Prefix) []netip.Prefix {
+	var parts []netip.Prefix
+	for _, w := range watch {
+		if w.Bits() <= p.Bits() && w.Contains(p.Addr()) {
+			return []netip.Prefix{p}
+		}
+		if w.Bits() > p.Bits() && p.Contains(w.Addr()) {
+			parts = append(parts, w)
+		}
+	}
+	return parts
+}
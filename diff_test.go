@@ -0,0 +1,115 @@
+package ipdb
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	from := buildCity(t, []string{"country_code", "city_name"}, testNetworks{
+		"1.0.0.0/8":     {"CN": {"CN", "北京"}},
+		"2.0.0.0/8":     {"CN": {"US", "纽约"}},
+		"2001:db8::/32": {"CN": {"JP", "东京"}},
+	})
+	to := buildCity(t, []string{"country_code", "city_name"}, testNetworks{
+		"1.0.0.0/8":     {"CN": {"CN", "北京"}},
+		"1.2.3.0/24":    {"CN": {"CN", "上海"}},
+		"2.0.0.0/8":     {"CN": {"US", "纽约"}},
+		"2.1.0.0/16":    {"CN": {"DE", "柏林"}},
+		"2001:db8::/32": {"CN": {"JP", "大阪"}},
+	})
+
+	report, err := Diff(from, to, DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("1.2.3.0/24"),
+		netip.MustParsePrefix("2.1.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	if len(report.Changes) != len(want) {
+		t.Fatalf("Changes = %+v", report.Changes)
+	}
+	for i, c := range report.Changes {
+		if c.Prefix != want[i] {
+			t.Errorf("Changes[%d] = %+v, want %s", i, c, want[i])
+		}
+	}
+	if f := report.Changes[1].Fields; len(f) != 2 || f[0] != (FieldChange{"country_code", "US", "DE"}) {
+		t.Errorf("Fields = %+v", f)
+	}
+	if report.IPv4Addresses != 256+65536 || report.ByCountry["US"] != 1 || report.ByCountry["DE"] != 1 ||
+		report.ByCountry["CN"] != 1 || report.ByField["city_name"] != 3 || report.ByField["country_code"] != 1 {
+		t.Errorf("report = %+v", report)
+	}
+
+	// watched networks clip the changes
+	report, err = Diff(from, to, DiffOptions{Watch: []netip.Prefix{
+		netip.MustParsePrefix("1.2.0.0/16"),
+		netip.MustParsePrefix("2.1.2.0/24"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 2 || report.Changes[0].Prefix.String() != "1.2.3.0/24" || report.Changes[1].Prefix.String() != "2.1.2.0/24" {
+		t.Fatalf("Changes = %+v", report.Changes)
+	}
+
+	report, err = Diff(from, to, DiffOptions{Countries: []string{"US"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 1 || report.Changes[0].Country != "DE" {
+		t.Fatalf("Changes = %+v", report.Changes)
+	}
+}
+
+func TestCity_DiffSelf(t *testing.T) {
+	report, err := Diff(db, db, DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 0 || report.Language != "CN" || len(report.Fields) != 3 {
+		t.Fatalf("Diff = %+v", report)
+	}
+}
+
+func TestDiff_Cycle(t *testing.T) {
+	cdb, err := NewCityFromBytes(selfLoopDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range [][2]Database{{cdb, db}, {db, cdb}} {
+		if _, err := Diff(pair[0], pair[1], DiffOptions{}); !errors.Is(err, ErrDatabaseError) {
+			t.Fatalf("Diff with a cyclic tree = %v", err)
+		}
+	}
+}
+
+func TestDiff_NestedWatch(t *testing.T) {
+	from := buildCity(t, []string{"country_code", "city_name"}, testNetworks{
+		"0.0.0.0/1": {"CN": {"CN", "北京"}},
+	})
+	to := buildCity(t, []string{"country_code", "city_name"}, testNetworks{
+		"0.0.0.0/1": {"CN": {"CN", "上海"}},
+	})
+
+	// a change under nested and repeated watched networks is reported once
+	report, err := Diff(from, to, DiffOptions{Watch: []netip.Prefix{
+		netip.MustParsePrefix("1.1.0.0/16"),
+		netip.MustParsePrefix("1.0.0.0/8"),
+		netip.MustParsePrefix("1.0.0.0/8"),
+		netip.MustParsePrefix("1.1.1.0/24"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 1 || report.Changes[0].Prefix.String() != "1.0.0.0/8" {
+		t.Fatalf("Changes = %+v", report.Changes)
+	}
+	if report.IPv4Addresses != 1<<24 || report.ByCountry["CN"] != 1 || report.ByField["city_name"] != 1 {
+		t.Errorf("report = %+v", report)
+	}
+}
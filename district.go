@@ -1,9 +1,9 @@
 package ipdb
 
 import (
-	"reflect"
-	"time"
-	"os"
+	"io"
+	"io/fs"
+	"net/netip"
 )
 
 type DistrictInfo struct {
@@ -18,102 +18,99 @@ type DistrictInfo struct {
 }
 
 type District struct {
-	reader *reader
+	database
 }
 
 func NewDistrict(name string) (*District, error) {
+	return OpenDistrict(name)
+}
+
+func OpenDistrict(name string, opts ...Option) (*District, error) {
 
-	r, e := newReader(name, &DistrictInfo{})
-	if e != nil {
+	db := &District{}
+	if e := db.open(name, &DistrictInfo{}, opts); e != nil {
 		return nil, e
 	}
 
-	return &District{
-		reader: r,
-	}, nil
+	return db, nil
 }
 
-func (db *District) Reload(name string) error {
-
-	_, err := os.Stat(name)
-	if err != nil {
-		return err
+func NewDistrictFromBytes(bs []byte) (*District, error) {
+	db := &District{}
+	if e := db.openBytes(bs, &DistrictInfo{}); e != nil {
+		return nil, e
 	}
 
-	reader, err := newReader(name, &DistrictInfo{})
-	if err != nil {
-		return err
-	}
+	return db, nil
+}
 
-	db.reader = reader
+// OpenDistrictFS initialize with the file name of fsys, such as an embed.FS
+func OpenDistrictFS(fsys fs.FS, name string, opts ...Option) (*District, error) {
+	db := &District{}
+	if e := db.openFS(fsys, name, &DistrictInfo{}, opts); e != nil {
+		return nil, e
+	}
 
-	return nil
+	return db, nil
 }
 
-func (db *District) Find(addr, language string) ([]string, error) {
-	return db.reader.find1(addr, language)
-}
+// OpenDistrictReader initialize with the file read from r, size bytes or all
+// of r if size is negative
+func OpenDistrictReader(r io.Reader, size int64, opts ...Option) (*District, error) {
+	db := &District{}
+	if e := db.openReader(r, size, &DistrictInfo{}, opts); e != nil {
+		return nil, e
+	}
 
-func (db *District) FindMap(addr, language string) (map[string]string, error) {
+	return db, nil
+}
 
-	data, err := db.reader.find1(addr, language)
-	if err != nil {
+// Snapshot returns a District pinned to the currently loaded build, so that
+// several lookups see the same data even if Reload runs in between.
+// The snapshot can not be reloaded; Close it when done.
+func (db *District) Snapshot() (*District, error) {
+	s := &District{}
+	if err := db.pin(&s.database); err != nil {
 		return nil, err
 	}
-	info := make(map[string]string, len(db.reader.meta.Fields))
-	for k, v := range data {
-		info[db.reader.meta.Fields[k]] = v
-	}
 
-	return info, nil
+	return s, nil
 }
 
 func (db *District) FindInfo(addr, language string) (*DistrictInfo, error) {
 
-	data, err := db.reader.FindMap(addr, language)
+	ip, err := parseAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	info := &DistrictInfo{}
-
-	for k, v := range data {
-		sv := reflect.ValueOf(info).Elem()
-		sfv := sv.FieldByName(db.reader.refType[k])
+	return db.FindInfoAddr(ip, language)
+}
 
-		if !sfv.IsValid() {
-			continue
-		}
-		if !sfv.CanSet() {
-			continue
-		}
+func (db *District) FindInfoAddr(addr netip.Addr, language string) (*DistrictInfo, error) {
 
-		sft := sfv.Type()
-		fv := reflect.ValueOf(v)
-		if sft == fv.Type() {
-			sfv.Set(fv)
-		}
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
 	}
+	defer r.release()
 
-	return info, nil
-}
+	buf := r.fieldBuf()
+	defer r.putFieldBuf(buf)
+	data, err := r.findInto(addr, language, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
 
-func (db *District) IsIPv4() bool {
-	return db.reader.IsIPv4Support()
-}
+	info, _ := decodeInfo[DistrictInfo](r, data)
 
-func (db *District) IsIPv6() bool {
-	return db.reader.IsIPv6Support()
+	return info, nil
 }
 
-func (db *District) Languages() []string {
-	return db.reader.Languages()
+func (db *District) FindInfoLang(addr string, languages []string) (*DistrictInfo, error) {
+	return findInfoLang[DistrictInfo](&db.database, addr, languages)
 }
 
-func (db *District) Fields() []string {
-	return db.reader.meta.Fields
+func (db *District) FindAllLanguages(addr string) (map[string]*DistrictInfo, error) {
+	return findAllLanguages[DistrictInfo](&db.database, addr)
 }
-
-func (db *District) BuildTime() time.Time {
-	return db.reader.Build()
-}
\ No newline at end of file
@@ -0,0 +1,59 @@
+package ipdb
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func FuzzNewCityFromBytes(f *testing.F) {
+	f.Add(singleRecordDB(f, []string{"country_name", "city_name"}, map[string]int{"CN": 0, "EN": 2}, "中国\t北京\tChina\tBeijing"))
+	f.Add(singleRecordDB(f, []string{"country_name"}, map[string]int{"CN": 0}, ""))
+	if body, err := os.ReadFile("city.free.ipdb"); err == nil {
+		f.Add(body[:4096])
+	}
+	f.Add([]byte{0, 0, 0, 2, '{', '}'})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		cdb, err := NewCityFromBytes(body)
+		if err != nil {
+			var fe *FormatError
+			if !errors.As(err, &fe) {
+				t.Fatalf("error %v is not a *FormatError", err)
+			}
+			return
+		}
+
+		for _, addr := range []string{"0.0.0.0", "1.2.3.4", "255.255.255.255", "::", "2001:db8::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"} {
+			for _, language := range cdb.Languages() {
+				cdb.Find(addr, language)
+				cdb.FindInfo(addr, language)
+				cdb.FindWithNetwork(addr, language)
+			}
+		}
+		cdb.current().validate()
+	})
+}
+
+func FuzzCity_Find(f *testing.F) {
+	f.Add("1.1.1.1", []byte{118, 28, 1, 1})
+	f.Add("::ffff:118.28.1.1", []byte{})
+	f.Add("2001:250:200::", []byte{0x20, 0x01, 2, 0x50, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add("fe80::1%eth0", []byte{1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, addr string, raw []byte) {
+		db.Find(addr, "CN")
+		db.FindInfo(addr, "CN")
+		db.FindFields(addr, "CN", "city_name")
+		db.FindBytes(raw, "CN")
+
+		if ip, err := netip.ParseAddr(addr); err == nil {
+			res, err := db.FindAddrWithNetwork(ip, "CN")
+			if err == nil && !res.Prefix.Contains(ip.Unmap()) {
+				t.Fatalf("%s: prefix %s does not contain the address", addr, res.Prefix)
+			}
+		}
+	})
+}
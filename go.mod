@@ -1,3 +1,5 @@
 module github.com/ipipdotnet/ipdb-go
 
-go 1.14
+go 1.22
+
+require github.com/klauspost/compress v1.18.0
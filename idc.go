@@ -1,9 +1,9 @@
 package ipdb
 
 import (
-	"reflect"
-	"time"
-	"os"
+	"io"
+	"io/fs"
+	"net/netip"
 )
 
 type IDCInfo struct {
@@ -16,102 +16,99 @@ type IDCInfo struct {
 }
 
 type IDC struct {
-	reader *reader
+	database
 }
 
 func NewIDC(name string) (*IDC, error) {
+	return OpenIDC(name)
+}
+
+func OpenIDC(name string, opts ...Option) (*IDC, error) {
 
-	r, e := newReader(name, &IDCInfo{})
-	if e != nil {
+	db := &IDC{}
+	if e := db.open(name, &IDCInfo{}, opts); e != nil {
 		return nil, e
 	}
 
-	return &IDC{
-		reader: r,
-	}, nil
+	return db, nil
 }
 
-func (db *IDC) Reload(name string) error {
-
-	_, err := os.Stat(name)
-	if err != nil {
-		return err
+func NewIDCFromBytes(bs []byte) (*IDC, error) {
+	db := &IDC{}
+	if e := db.openBytes(bs, &IDCInfo{}); e != nil {
+		return nil, e
 	}
 
-	reader, err := newReader(name, &IDCInfo{})
-	if err != nil {
-		return err
-	}
+	return db, nil
+}
 
-	db.reader = reader
+// OpenIDCFS initialize with the file name of fsys, such as an embed.FS
+func OpenIDCFS(fsys fs.FS, name string, opts ...Option) (*IDC, error) {
+	db := &IDC{}
+	if e := db.openFS(fsys, name, &IDCInfo{}, opts); e != nil {
+		return nil, e
+	}
 
-	return nil
+	return db, nil
 }
 
-func (db *IDC) Find(addr, language string) ([]string, error) {
-	return db.reader.find1(addr, language)
-}
+// OpenIDCReader initialize with the file read from r, size bytes or all
+// of r if size is negative
+func OpenIDCReader(r io.Reader, size int64, opts ...Option) (*IDC, error) {
+	db := &IDC{}
+	if e := db.openReader(r, size, &IDCInfo{}, opts); e != nil {
+		return nil, e
+	}
 
-func (db *IDC) FindMap(addr, language string) (map[string]string, error) {
+	return db, nil
+}
 
-	data, err := db.reader.find1(addr, language)
-	if err != nil {
+// Snapshot returns a IDC pinned to the currently loaded build, so that
+// several lookups see the same data even if Reload runs in between.
+// The snapshot can not be reloaded; Close it when done.
+func (db *IDC) Snapshot() (*IDC, error) {
+	s := &IDC{}
+	if err := db.pin(&s.database); err != nil {
 		return nil, err
 	}
-	info := make(map[string]string, len(db.reader.meta.Fields))
-	for k, v := range data {
-		info[db.reader.meta.Fields[k]] = v
-	}
 
-	return info, nil
+	return s, nil
 }
 
 func (db *IDC) FindInfo(addr, language string) (*IDCInfo, error) {
 
-	data, err := db.reader.FindMap(addr, language)
+	ip, err := parseAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	info := &IDCInfo{}
-
-	for k, v := range data {
-		sv := reflect.ValueOf(info).Elem()
-		sfv := sv.FieldByName(db.reader.refType[k])
+	return db.FindInfoAddr(ip, language)
+}
 
-		if !sfv.IsValid() {
-			continue
-		}
-		if !sfv.CanSet() {
-			continue
-		}
+func (db *IDC) FindInfoAddr(addr netip.Addr, language string) (*IDCInfo, error) {
 
-		sft := sfv.Type()
-		fv := reflect.ValueOf(v)
-		if sft == fv.Type() {
-			sfv.Set(fv)
-		}
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
 	}
+	defer r.release()
 
-	return info, nil
-}
+	buf := r.fieldBuf()
+	defer r.putFieldBuf(buf)
+	data, err := r.findInto(addr, language, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
 
-func (db *IDC) IsIPv4() bool {
-	return db.reader.IsIPv4Support()
-}
+	info, _ := decodeInfo[IDCInfo](r, data)
 
-func (db *IDC) IsIPv6() bool {
-	return db.reader.IsIPv6Support()
+	return info, nil
 }
 
-func (db *IDC) Languages() []string {
-	return db.reader.Languages()
+func (db *IDC) FindInfoLang(addr string, languages []string) (*IDCInfo, error) {
+	return findInfoLang[IDCInfo](&db.database, addr, languages)
 }
 
-func (db *IDC) Fields() []string {
-	return db.reader.meta.Fields
+func (db *IDC) FindAllLanguages(addr string) (map[string]*IDCInfo, error) {
+	return findAllLanguages[IDCInfo](&db.database, addr)
 }
-
-func (db *IDC) BuildTime() time.Time {
-	return db.reader.Build()
-}
\ No newline at end of file
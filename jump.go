@@ -0,0 +1,62 @@
+package ipdb
+
+// defaultJumpBits is the size of the IPv4 jump table unless
+// WithIPv4JumpTable says otherwise
+const defaultJumpBits = 16
+
+// maxJumpBits bounds the jump table to 16M entries, 80MB
+const maxJumpBits = 24
+
+// jumpTable holds, for every value of the first bits of an IPv4 address,
+// the node reached from the IPv4 root by walking them, so that a lookup
+// starts below it. A walk that ends in a leaf or an empty branch before
+// that depth stores the leaf and the depth it was reached at.
+type jumpTable struct {
+	bits  int
+	nodes []uint32
+	depth []uint8
+}
+
+// buildJumpTable returns the jump table of the first bits levels below
+// the IPv4 root, nil if bits is 0 or the database has no IPv4
+func (db *reader) buildJumpTable(bits int) *jumpTable {
+	if bits <= 0 || !db.IsIPv4Support() {
+		return nil
+	}
+	if bits > maxJumpBits {
+		bits = maxJumpBits
+	}
+
+	t := &jumpTable{
+		bits:  bits,
+		nodes: make([]uint32, 1<<uint(bits)),
+		depth: make([]uint8, 1<<uint(bits)),
+	}
+	t.fill(db, db.v4offset, 0, 0)
+
+	return t
+}
+
+// fill stores the entries below node, reached by the first depth bits
+// of prefix
+func (t *jumpTable) fill(db *reader, node, prefix, depth int) {
+	if depth == t.bits || node >= db.nodeCount {
+		// every entry starting with prefix
+		shift := uint(t.bits - depth)
+		for i := prefix << shift; i < (prefix+1)<<shift; i++ {
+			t.nodes[i] = uint32(node)
+			t.depth[i] = uint8(depth)
+		}
+		return
+	}
+
+	t.fill(db, db.readNode(node, 0), prefix<<1, depth+1)
+	t.fill(db, db.readNode(node, 1), prefix<<1|1, depth+1)
+}
+
+// start returns the node and depth to continue the search of the IPv4
+// address ip from
+func (t *jumpTable) start(ip []byte) (int, int) {
+	i := (int(ip[0])<<24 | int(ip[1])<<16 | int(ip[2])<<8 | int(ip[3])) >> uint(32-t.bits)
+	return int(t.nodes[i]), int(t.depth[i])
+}
@@ -0,0 +1,149 @@
+package ipdb
+
+import (
+	"bytes"
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+// lastAddr returns the last address of p
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As16()
+	for i := p.Bits() + 128 - p.Addr().BitLen(); i < 128; i++ {
+		a[i/8] |= 1 << uint(7-i%8)
+	}
+	if p.Addr().Is4() {
+		return netip.AddrFrom16(a).Unmap()
+	}
+	return netip.AddrFrom16(a)
+}
+
+// sameLookups checks that every network of want, empty ones included,
+// is found the same by got at its first and last address
+func sameLookups(t *testing.T, want, got *City) {
+	t.Helper()
+
+	it, err := want.Networks(NetworksOptions{IncludeEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	n := 0
+	for it.Next() {
+		prefix, _ := it.Network()
+		for _, addr := range []netip.Addr{prefix.Addr(), lastAddr(prefix)} {
+			w, werr := want.FindWithNetwork(addr.String(), "CN")
+			g, gerr := got.FindWithNetwork(addr.String(), "CN")
+			if werr != gerr || w.Prefix != g.Prefix || !equalStrings(w.Record, g.Record) {
+				t.Fatalf("FindWithNetwork(%s) = %+v, %v, want %+v, %v", addr, g, gerr, w, werr)
+			}
+		}
+		n++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("no networks")
+	}
+}
+
+func TestWithIPv4JumpTable(t *testing.T) {
+	body := cityCopy(t, 1000)
+	want, err := OpenCityReader(bytes.NewReader(body), -1, WithIPv4JumpTable(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.current().jump != nil {
+		t.Fatal("WithIPv4JumpTable(0) built a table")
+	}
+
+	for _, bits := range []int{1, 8, 16, 24, 32} {
+		got, err := OpenCityReader(bytes.NewReader(body), -1, WithIPv4JumpTable(bits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := got.current().jump.bits; n != bits && !(bits > maxJumpBits && n == maxJumpBits) {
+			t.Fatalf("WithIPv4JumpTable(%d) built %d bits", bits, n)
+		}
+		sameLookups(t, want, got)
+	}
+
+	// the table is rebuilt on reload
+	cdb, err := OpenCityReader(bytes.NewReader(body), -1, WithIPv4JumpTable(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cdb.ReloadReader(bytes.NewReader(body), -1); err != nil {
+		t.Fatal(err)
+	}
+	if n := cdb.current().jump.bits; n != 8 {
+		t.Fatalf("jump table after Reload has %d bits", n)
+	}
+
+	// databases loaded from bytes get the default table, also on reload
+	name := filepath.Join(t.TempDir(), "city.ipdb")
+	writeFile(t, name, body)
+	bdb, err := NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bdb.current().jump == nil {
+		t.Fatal("NewCityFromBytes built no table")
+	}
+	if err := bdb.Reload(name); err != nil {
+		t.Fatal(err)
+	}
+	if j := bdb.current().jump; j == nil || j.bits != defaultJumpBits {
+		t.Fatalf("jump table after Reload = %+v", j)
+	}
+	odb, err := OpenBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if odb.(*City).current().jump == nil {
+		t.Fatal("OpenBytes built no table")
+	}
+}
+
+func TestWithIPv4JumpTable_Sparse(t *testing.T) {
+	// networks shorter, as long as and longer than the table
+	body := buildBytes(t, []string{"country_name", "region_name", "city_name"}, testNetworks{
+		"1.0.0.0/8":          {"CN": {"中国", "", "甲"}},
+		"2.3.0.0/16":         {"CN": {"中国", "", "乙"}},
+		"2.4.5.0/24":         {"CN": {"中国", "", "丙"}},
+		"2.4.5.128/25":       {"CN": {"中国", "", "丁"}},
+		"200.1.2.3/32":       {"CN": {"中国", "", "戊"}},
+		"2001:db8::/32":      {"CN": {"中国", "", "己"}},
+		"::ffff:9.0.0.0/104": {"CN": {"中国", "", "庚"}},
+	})
+
+	want, err := OpenCityReader(bytes.NewReader(body), -1, WithIPv4JumpTable(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bits := range []int{1, 7, 8, 16, 24} {
+		got, err := OpenCityReader(bytes.NewReader(body), -1, WithIPv4JumpTable(bits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameLookups(t, want, got)
+
+		if res, err := got.FindMap("2.4.5.200", "CN"); err != nil || res["city_name"] != "丁" {
+			t.Fatalf("bits %d: FindMap = %v, %v", bits, res, err)
+		}
+	}
+}
+
+func BenchmarkCity_Find_NoJumpTable(b *testing.B) {
+	cdb, err := OpenCity("city.free.ipdb", WithIPv4JumpTable(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cdb.Find("118.28.1.1", "CN")
+	}
+}
@@ -0,0 +1,294 @@
+package ipdb
+
+import (
+	"encoding/json"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LintKind classifies a data quality problem found by Lint
+type LintKind string
+
+const (
+	// LintCoordinates is a latitude or longitude that is not a number
+	// or out of range
+	LintCoordinates LintKind = "coordinates"
+	// LintTimezone is a timezone unknown to the tz database
+	LintTimezone LintKind = "timezone"
+	// LintASNInfo is an asn_info that is not valid JSON for []ASNInfo
+	LintASNInfo LintKind = "asn_info"
+	// LintChinaAdminCode is a china_admin_code that is not 6 digits
+	LintChinaAdminCode LintKind = "china_admin_code"
+	// LintLanguageEmptiness is a field set in some languages and empty
+	// in others
+	LintLanguageEmptiness LintKind = "language_emptiness"
+)
+
+// maxLintIssues bounds LintReport.Issues, IssueCount keeps counting
+const maxLintIssues = 1000
+
+// LintIssue is one problem found by Lint
+type LintIssue struct {
+	Kind LintKind `json:"kind"`
+	// Prefix of the first network using the record
+	Prefix   netip.Prefix `json:"prefix"`
+	Language string       `json:"language,omitempty"`
+	Field    string       `json:"field"`
+	Value    string       `json:"value,omitempty"`
+	Detail   string       `json:"detail,omitempty"`
+}
+
+// LintReport is the result of Lint
+type LintReport struct {
+	Records int `json:"records"`
+
+	// Checks lists the checks that ran, a check runs only if the
+	// database has its fields
+	Checks []LintKind `json:"checks"`
+
+	// EmptyCountryCode is the number of records with an empty
+	// country_code in every language
+	EmptyCountryCode      int     `json:"empty_country_code"`
+	EmptyCountryCodeShare float64 `json:"empty_country_code_share"`
+
+	// Counts is the number of records with at least one issue of a kind
+	Counts map[LintKind]int `json:"counts"`
+
+	// Issues holds the first problems found, IssueCount counts all
+	Issues     []LintIssue `json:"issues"`
+	IssueCount int         `json:"issue_count"`
+}
+
+// OK whether no issue was found
+func (r *LintReport) OK() bool {
+	return r.IssueCount == 0
+}
+
+func (r *LintReport) add(issue LintIssue) {
+	r.IssueCount++
+	if len(r.Issues) < maxLintIssues {
+		r.Issues = append(r.Issues, issue)
+	}
+}
+
+// Lint walks every record of the database and checks the values of
+// well known fields: coordinates, timezones, asn_info JSON,
+// china_admin_code, and fields whose emptiness differs between
+// languages. It also counts the records without a country_code. Records
+// that cannot be read are left to Verify.
+func (db *database) Lint() (*LintReport, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.lint(), nil
+}
+
+type linter struct {
+	db        *reader
+	report    *LintReport
+	languages []string
+	offsets   []int
+	timezones map[string]bool // name -> known
+
+	latitude, longitude, timezone, asnInfo, adminCode, countryCode int
+}
+
+func (db *reader) lint() *LintReport {
+	l := &linter{
+		db:        db,
+		report:    &LintReport{Counts: make(map[LintKind]int)},
+		timezones: make(map[string]bool),
+	}
+	for language := range db.meta.Languages {
+		l.languages = append(l.languages, language)
+	}
+	sort.Strings(l.languages)
+	for _, language := range l.languages {
+		l.offsets = append(l.offsets, db.meta.Languages[language])
+	}
+
+	field := func(name string, kind LintKind) int {
+		i, ok := db.fieldIndex[name]
+		if !ok {
+			return -1
+		}
+		if kind != "" {
+			l.addCheck(kind)
+		}
+		return i
+	}
+	l.latitude = field("latitude", LintCoordinates)
+	l.longitude = field("longitude", LintCoordinates)
+	l.timezone = field("timezone", LintTimezone)
+	l.asnInfo = field("asn_info", LintASNInfo)
+	l.adminCode = field("china_admin_code", LintChinaAdminCode)
+	l.countryCode = field("country_code", "")
+	if len(l.languages) > 1 {
+		l.addCheck(LintLanguageEmptiness)
+	}
+
+	values := make([][]string, len(l.languages))
+	for i := range values {
+		values[i] = make([]string, 0, len(db.meta.Fields))
+	}
+	records := make(map[int]bool)
+
+	w := db.walkLeaves(0, [16]byte{}, 0)
+	w.seen = make([]bool, db.nodeCount)
+	for {
+		leaf, prefix, ok := w.next()
+		if !ok {
+			break
+		}
+		if records[leaf] {
+			continue
+		}
+		records[leaf] = true
+
+		body, err := db.resolve(leaf)
+		if err != nil {
+			continue
+		}
+		for i, off := range l.offsets {
+			if values[i], err = db.fieldsInto(leaf, body, off, values[i]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+
+		l.report.Records++
+		l.record(prefix, values)
+	}
+
+	if l.countryCode >= 0 && l.report.Records > 0 {
+		l.report.EmptyCountryCodeShare = float64(l.report.EmptyCountryCode) / float64(l.report.Records)
+	}
+
+	return l.report
+}
+
+func (l *linter) addCheck(kind LintKind) {
+	for _, k := range l.report.Checks {
+		if k == kind {
+			return
+		}
+	}
+	l.report.Checks = append(l.report.Checks, kind)
+}
+
+// record checks the values of one record, values[i] in l.languages[i]
+func (l *linter) record(prefix netip.Prefix, values [][]string) {
+	found := make(map[LintKind]bool)
+	for i, language := range l.languages {
+		data := values[i]
+		issue := func(kind LintKind, field int, detail string) {
+			found[kind] = true
+			l.report.add(LintIssue{Kind: kind, Prefix: prefix, Language: language,
+				Field: l.db.meta.Fields[field], Value: data[field], Detail: detail})
+		}
+
+		if l.latitude >= 0 {
+			if detail := checkCoordinate(data[l.latitude], 90); detail != "" {
+				issue(LintCoordinates, l.latitude, detail)
+			}
+		}
+		if l.longitude >= 0 {
+			if detail := checkCoordinate(data[l.longitude], 180); detail != "" {
+				issue(LintCoordinates, l.longitude, detail)
+			}
+		}
+		if l.timezone >= 0 && data[l.timezone] != "" && !l.knownTimezone(data[l.timezone]) {
+			issue(LintTimezone, l.timezone, "unknown time zone")
+		}
+		if l.asnInfo >= 0 && data[l.asnInfo] != "" {
+			var v []ASNInfo
+			if err := json.Unmarshal([]byte(data[l.asnInfo]), &v); err != nil {
+				issue(LintASNInfo, l.asnInfo, err.Error())
+			}
+		}
+		if l.adminCode >= 0 && data[l.adminCode] != "" && !isAdminCode(data[l.adminCode]) {
+			issue(LintChinaAdminCode, l.adminCode, "want 6 digits")
+		}
+	}
+
+	if l.countryCode >= 0 {
+		empty := true
+		for i := range l.languages {
+			if values[i][l.countryCode] != "" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			l.report.EmptyCountryCode++
+		}
+	}
+
+	if len(l.languages) > 1 {
+		for field := range l.db.meta.Fields {
+			var set, unset []string
+			for i, language := range l.languages {
+				if values[i][field] == "" {
+					unset = append(unset, language)
+				} else {
+					set = append(set, language)
+				}
+			}
+			if len(set) > 0 && len(unset) > 0 {
+				found[LintLanguageEmptiness] = true
+				l.report.add(LintIssue{Kind: LintLanguageEmptiness, Prefix: prefix, Field: l.db.meta.Fields[field],
+					Detail: "empty in " + strings.Join(unset, ",") + ", set in " + strings.Join(set, ",")})
+			}
+		}
+	}
+
+	for kind := range found {
+		l.report.Counts[kind]++
+	}
+}
+
+func (l *linter) knownTimezone(name string) bool {
+	known, ok := l.timezones[name]
+	if !ok {
+		// Local is a name of time.LoadLocation, not of the tz database
+		_, err := time.LoadLocation(name)
+		known = err == nil && name != "Local"
+		l.timezones[name] = known
+	}
+	return known
+}
+
+// checkCoordinate returns why v is not a coordinate within ±limit, or ""
+func checkCoordinate(v string, limit float64) string {
+	if v == "" {
+		return ""
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return "not a number"
+	}
+	if f < -limit || f > limit {
+		return "out of range ±" + strconv.FormatFloat(limit, 'f', -1, 64)
+	}
+	return ""
+}
+
+func isAdminCode(v string) bool {
+	if len(v) != 6 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < '0' || v[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
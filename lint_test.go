@@ -0,0 +1,56 @@
+package ipdb
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCity_Lint(t *testing.T) {
+	report, err := db.Lint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records == 0 || !report.OK() {
+		t.Fatalf("Lint city.free.ipdb = %+v", report)
+	}
+}
+
+func TestLint_Issues(t *testing.T) {
+	fields := []string{"country_code", "latitude", "longitude", "timezone", "asn_info", "china_admin_code"}
+	record := "\t91.5\t116.4\tAsia/Nowhere\t[{\"asn\":\t11000" +
+		"\t\t39.9\t-181\tAsia/Shanghai\t\t110000"
+	cdb, err := NewCityFromBytes(singleRecordDB(t, fields, map[string]int{"CN": 0, "EN": 6}, record))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := cdb.Lint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 1 || report.EmptyCountryCode != 1 || report.EmptyCountryCodeShare != 1 {
+		t.Fatalf("Lint = %+v", report)
+	}
+
+	want := map[LintKind]int{
+		LintCoordinates:       1,
+		LintTimezone:          1,
+		LintASNInfo:           1,
+		LintChinaAdminCode:    1,
+		LintLanguageEmptiness: 1,
+	}
+	for kind, n := range want {
+		if report.Counts[kind] != n {
+			t.Errorf("Counts[%s] = %d, want %d", kind, report.Counts[kind], n)
+		}
+	}
+	// latitude in CN, longitude in EN, and asn_info set only in CN
+	if report.IssueCount != 6 {
+		t.Fatalf("Lint issues = %+v", report.Issues)
+	}
+	for _, issue := range report.Issues {
+		if issue.Prefix != netip.MustParsePrefix("0.0.0.0/1") {
+			t.Fatalf("issue %+v, want prefix 0.0.0.0/1", issue)
+		}
+	}
+}
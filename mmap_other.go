@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package ipdb
+
+import "os"
+
+func mmapFile(name string) ([]byte, func() error, error) {
+	body, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, ErrReadFull
+	}
+	if len(body) < 4 {
+		return nil, nil, formatError(ErrFileSize, len(body), -1, "file too short for the metadata length")
+	}
+
+	return body, nil, nil
+}
@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package ipdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenCityMmap_Truncated(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "city.ipdb")
+	body := cityCopy(t, 1000)
+	writeFile(t, name, body)
+
+	cdb, err := OpenCity(name, WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+
+	// rewriting in place truncates the file under the mapping first
+	if err := os.Truncate(name, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cdb.Find("118.28.1.1", "CN"); !errors.Is(err, ErrDatabaseError) {
+		t.Fatalf("Find on truncated file = %v", err)
+	}
+	if _, err := cdb.FindWithNetwork("36.102.4.81", "CN"); !errors.Is(err, ErrDatabaseError) {
+		t.Fatalf("FindWithNetwork on truncated file = %v", err)
+	}
+
+	writeFile(t, name, body)
+	if err := cdb.Reload(name); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := cdb.FindMap("118.28.1.1", "CN"); err != nil || res["city_name"] != "天津" {
+		t.Fatalf("FindMap after Reload = %v, %v", res, err)
+	}
+}
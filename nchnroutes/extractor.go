@@ -1,30 +1,21 @@
 package nchnroutes
 
 import (
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"net"
-	"os"
+	"net/netip"
+	"sort"
 	"strings"
+
+	"github.com/ipipdotnet/ipdb-go"
 )
 
 // MetaData IPDB元数据结构
-type MetaData struct {
-	Build     int64          `json:"build"`
-	IPVersion uint16         `json:"ip_version"`
-	Languages map[string]int `json:"languages"`
-	NodeCount int            `json:"node_count"`
-	TotalSize int            `json:"total_size"`
-	Fields    []string       `json:"fields"`
-}
+type MetaData = ipdb.MetaData
 
-// IPDBExtractor IPDB提取器
+// IPDBExtractor IPDB提取器，基于ipdb包的数据库读取和遍历
 type IPDBExtractor struct {
-	data      []byte
-	nodeCount int
-	v4offset  int
-	meta      MetaData
+	db ipdb.Database
 }
 
 // IPRange IP范围结构
@@ -39,252 +30,181 @@ type IPRange struct {
 
 // NewExtractor 创建新的IPDB提取器
 func NewExtractor(filename string) (*IPDBExtractor, error) {
-	body, err := os.ReadFile(filename)
+	return OpenExtractor(filename)
+}
+
+// OpenExtractor 使用加载选项创建IPDB提取器，如 ipdb.WithMmap()
+func OpenExtractor(filename string, opts ...ipdb.Option) (*IPDBExtractor, error) {
+	db, err := ipdb.Open(filename, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	metaLength := int(binary.BigEndian.Uint32(body[0:4]))
-	var meta MetaData
-	if err := json.Unmarshal(body[4:4+metaLength], &meta); err != nil {
+	return &IPDBExtractor{db: db}, nil
+}
+
+// NewExtractorFromBytes 从内存中的IPDB文件创建提取器
+func NewExtractorFromBytes(body []byte) (*IPDBExtractor, error) {
+	db, err := ipdb.OpenBytes(body)
+	if err != nil {
 		return nil, err
 	}
 
-	extractor := &IPDBExtractor{
-		data:      body[4+metaLength:],
-		nodeCount: meta.NodeCount,
-		meta:      meta,
-	}
+	return &IPDBExtractor{db: db}, nil
+}
 
-	extractor.calculateV4Offset()
-	return extractor, nil
+// NewExtractorFromDatabase 从已加载的数据库创建提取器，Close会关闭该数据库
+func NewExtractorFromDatabase(db ipdb.Database) *IPDBExtractor {
+	return &IPDBExtractor{db: db}
 }
 
 // GetMeta 获取元数据
 func (e *IPDBExtractor) GetMeta() MetaData {
-	return e.meta
+	return e.db.Meta()
 }
 
-func (e *IPDBExtractor) calculateV4Offset() {
-	node := 0
-	for i := 0; i < 96 && node < e.nodeCount; i++ {
-		if i >= 80 {
-			node = e.readNode(node, 1)
-		} else {
-			node = e.readNode(node, 0)
-		}
-	}
-	e.v4offset = node
+// Database 返回提取器使用的数据库
+func (e *IPDBExtractor) Database() ipdb.Database {
+	return e.db
 }
 
-func (e *IPDBExtractor) readNode(node, index int) int {
-	off := node*8 + index*4
-	return int(binary.BigEndian.Uint32(e.data[off : off+4]))
-}
-
-func (e *IPDBExtractor) resolve(node int) ([]byte, error) {
-	resolved := node - e.nodeCount + e.nodeCount*8
-	if resolved >= len(e.data) {
-		return nil, fmt.Errorf("database error")
-	}
-
-	size := int(binary.BigEndian.Uint16(e.data[resolved : resolved+2]))
-	if (resolved + 2 + size) > len(e.data) {
-		return nil, fmt.Errorf("database error")
-	}
-	bytes := e.data[resolved+2 : resolved+2+size]
-
-	return bytes, nil
+// Close 关闭数据库
+func (e *IPDBExtractor) Close() error {
+	return e.db.Close()
 }
 
 // ExtractAllRanges 提取所有IP范围（IPv4和IPv6）
 func (e *IPDBExtractor) ExtractAllRanges() ([]IPRange, []IPRange, error) {
-	var ipv4Ranges, ipv6Ranges []IPRange
-
-	if (e.meta.IPVersion & 0x01) != 0 {
-		e.traverseIPv4Node(e.v4offset, make([]int, 0, 32), &ipv4Ranges)
-	}
-
-	if (e.meta.IPVersion & 0x02) != 0 {
-		e.traverseIPv6NodeFromRoot(0, make([]int, 0, 128), &ipv6Ranges)
+	// 整个提取过程使用同一版本的数据，期间的 Reload 不影响结果
+	db, done, err := snapshot(e.db)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer done()
 
-	return ipv4Ranges, ipv6Ranges, nil
-}
+	var ipv4Ranges, ipv6Ranges []IPRange
 
-func (e *IPDBExtractor) traverseIPv4Node(node int, path []int, ranges *[]IPRange) {
-	if node >= e.nodeCount {
-		data, err := e.resolve(node)
+	if db.IsIPv4() {
+		ipv4Ranges, err = extract(db, ipdb.NetworksOptions{IPv4Only: true, IncludeEmpty: true}, "IPv4")
 		if err != nil {
-			return
+			return nil, nil, err
 		}
+	}
 
-		cidr, startIP, endIP := e.pathToCIDR(path, true)
-		str := string(data)
-		info := strings.Split(str, "\t")
-
-		ipRange := IPRange{
-			CIDR:    cidr,
-			StartIP: startIP,
-			EndIP:   endIP,
-			Info:    info,
-			RawData: str,
-			Type:    "IPv4",
+	if db.IsIPv6() {
+		ipv6Ranges, err = extract(db, ipdb.NetworksOptions{IPv6Only: true, IncludeEmpty: true}, "IPv6")
+		if err != nil {
+			return nil, nil, err
 		}
-
-		*ranges = append(*ranges, ipRange)
-		return
 	}
 
-	leftNode := e.readNode(node, 0)
-	rightNode := e.readNode(node, 1)
+	return ipv4Ranges, ipv6Ranges, nil
+}
 
-	if leftNode != 0 {
-		newPath := append(path, 0)
-		e.traverseIPv4Node(leftNode, newPath, ranges)
+// snapshot 返回固定在当前版本上的数据库及其释放函数，
+// 不支持快照的数据库原样返回
+func snapshot(db ipdb.Database) (ipdb.Database, func(), error) {
+	var snap ipdb.Database
+	var err error
+	switch db := db.(type) {
+	case *ipdb.City:
+		snap, err = pinned(db.Snapshot())
+	case *ipdb.IDC:
+		snap, err = pinned(db.Snapshot())
+	case *ipdb.District:
+		snap, err = pinned(db.Snapshot())
+	case *ipdb.BaseStation:
+		snap, err = pinned(db.Snapshot())
+	case *ipdb.Risk:
+		snap, err = pinned(db.Snapshot())
+	default:
+		return db, func() {}, nil
 	}
-
-	if rightNode != 0 {
-		newPath := append(path, 1)
-		e.traverseIPv4Node(rightNode, newPath, ranges)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	return snap, func() { snap.Close() }, nil
 }
 
-func (e *IPDBExtractor) traverseIPv6NodeFromRoot(node int, path []int, ranges *[]IPRange) {
-	if len(path) == 96 && e.isIPv4MappedPath(path) {
-		return
+// pinned 将具体类型的快照转为 ipdb.Database，出错时不返回带类型的 nil
+func pinned[T ipdb.Database](snap T, err error) (ipdb.Database, error) {
+	if err != nil {
+		return nil, err
 	}
+	return snap, nil
+}
 
-	if len(path) < 80 {
-		allZeros := true
-		for _, bit := range path {
-			if bit != 0 {
-				allZeros = false
-				break
-			}
-		}
-		if allZeros && len(path) >= 70 {
+// extract 按地址顺序提取网段，Info 为按记录中的顺序排列的所有语言的字段，
+// 没有记录的网段 Info 为 [""]
+func extract(db ipdb.Database, opts ipdb.NetworksOptions, typ string) ([]IPRange, error) {
+	// 每种语言一个迭代器，同一快照上的各迭代器按相同顺序返回相同的网段
+	meta := db.Meta()
+	languages := make([]string, 0, len(meta.Languages))
+	for language := range meta.Languages {
+		languages = append(languages, language)
+	}
+	sort.Slice(languages, func(i, j int) bool {
+		return meta.Languages[languages[i]] < meta.Languages[languages[j]]
+	})
+
+	iters := make([]*ipdb.NetworkIterator, len(languages))
+	for i, language := range languages {
+		opts.Language = language
+		it, err := db.Networks(opts)
+		if err != nil {
+			return nil, err
 		}
-	}
-
-	if node >= e.nodeCount {
-		if !e.isIPv4MappedPath(path) {
-			data, err := e.resolve(node)
-			if err != nil {
-				return
+		defer it.Close()
+		iters[i] = it
+	}
+
+	var ranges []IPRange
+	for len(iters) > 0 && iters[0].Next() {
+		prefix, record := iters[0].Network()
+		info := record
+		for _, it := range iters[1:] {
+			if !it.Next() {
+				if err := it.Err(); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("%w: 各语言的网段数不一致", ipdb.ErrDatabaseError)
 			}
-
-			cidr, startIP, endIP := e.pathToCIDR(path, false)
-			str := string(data)
-			info := strings.Split(str, "\t")
-
-			ipRange := IPRange{
-				CIDR:    cidr,
-				StartIP: startIP,
-				EndIP:   endIP,
-				Info:    info,
-				RawData: str,
-				Type:    "IPv6",
+			other, more := it.Network()
+			if other != prefix {
+				return nil, fmt.Errorf("%w: 各语言的网段不一致 %s %s", ipdb.ErrDatabaseError, prefix, other)
 			}
-
-			*ranges = append(*ranges, ipRange)
-		}
-		return
-	}
-
-	leftNode := e.readNode(node, 0)
-	rightNode := e.readNode(node, 1)
-
-	if leftNode != 0 {
-		newPath := append(path, 0)
-		e.traverseIPv6NodeFromRoot(leftNode, newPath, ranges)
-	}
-
-	if rightNode != 0 {
-		newPath := append(path, 1)
-		e.traverseIPv6NodeFromRoot(rightNode, newPath, ranges)
-	}
-}
-
-func (e *IPDBExtractor) isIPv4MappedPath(path []int) bool {
-	if len(path) < 96 {
-		return false
-	}
-
-	for i := 0; i < 80; i++ {
-		if path[i] != 0 {
-			return false
+			info = append(info, more...)
 		}
-	}
 
-	for i := 80; i < 96; i++ {
-		if path[i] != 1 {
-			return false
+		if record == nil {
+			info = []string{""}
 		}
+		ranges = append(ranges, prefixToRange(prefix, info, typ))
 	}
-
-	return true
-}
-
-func (e *IPDBExtractor) pathToCIDR(path []int, isIPv4 bool) (string, net.IP, net.IP) {
-	var ip net.IP
-	var prefixLen int
-
-	if isIPv4 {
-		ip = make(net.IP, 4)
-		prefixLen = len(path)
-
-		for i, bit := range path {
-			if bit == 1 {
-				byteIndex := i / 8
-				bitIndex := 7 - (i % 8)
-				ip[byteIndex] |= 1 << bitIndex
-			}
-		}
-	} else {
-		ip = make(net.IP, 16)
-		prefixLen = len(path)
-
-		for i, bit := range path {
-			if bit == 1 {
-				byteIndex := i / 8
-				bitIndex := 7 - (i % 8)
-				ip[byteIndex] |= 1 << bitIndex
-			}
+	for _, it := range iters {
+		if err := it.Err(); err != nil {
+			return nil, err
 		}
 	}
 
-	cidr := fmt.Sprintf("%s/%d", ip.String(), prefixLen)
-	startIP := make(net.IP, len(ip))
-	copy(startIP, ip)
-	endIP := e.calculateEndIP(ip, prefixLen, isIPv4)
-
-	return cidr, startIP, endIP
+	return ranges, nil
 }
 
-func (e *IPDBExtractor) calculateEndIP(startIP net.IP, prefixLen int, isIPv4 bool) net.IP {
-	var totalBits int
-	if isIPv4 {
-		totalBits = 32
-	} else {
-		totalBits = 128
-	}
-
-	hostBits := totalBits - prefixLen
-	if hostBits == 0 {
-		endIP := make(net.IP, len(startIP))
-		copy(endIP, startIP)
-		return endIP
-	}
-
+func prefixToRange(prefix netip.Prefix, info []string, typ string) IPRange {
+	startIP := net.IP(prefix.Addr().AsSlice())
 	endIP := make(net.IP, len(startIP))
 	copy(endIP, startIP)
-
-	for i := prefixLen; i < totalBits; i++ {
-		byteIndex := i / 8
-		bitIndex := 7 - (i % 8)
-		endIP[byteIndex] |= 1 << bitIndex
+	for i := prefix.Bits(); i < len(endIP)*8; i++ {
+		endIP[i/8] |= 1 << (7 - i%8)
 	}
 
-	return endIP
+	return IPRange{
+		CIDR:    fmt.Sprintf("%s/%d", startIP.String(), prefix.Bits()),
+		StartIP: startIP,
+		EndIP:   endIP,
+		Info:    info,
+		RawData: strings.Join(info, "\t"),
+		Type:    typ,
+	}
 }
@@ -0,0 +1,163 @@
+package ipdb
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var ErrNetworksOptions = errors.New("IPv4Only and IPv6Only are exclusive")
+
+// NetworksOptions selects the networks Networks yields
+type NetworksOptions struct {
+	// Language of the records, CN if empty
+	Language string
+
+	IPv4Only bool
+	IPv6Only bool
+
+	// IncludeEmpty also yields the networks without a record, with a
+	// nil record
+	IncludeEmpty bool
+
+	// IncludeIPv4Mapped also yields the IPv4 networks in their IPv6
+	// form under ::ffff:0:0/96, in the IPv6 part of the walk
+	IncludeIPv4Mapped bool
+}
+
+// NetworkIterator yields the networks of a database and their records.
+// It holds the build it was created on until it is done or closed, a
+// Reload in between does not affect it.
+//
+//	it, err := db.Networks(ipdb.NetworksOptions{IPv4Only: true})
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		prefix, record := it.Network()
+//	}
+//	return it.Err()
+type NetworkIterator struct {
+	r      *reader
+	off    int
+	walks  []*leafWalker
+	mapped []bool // whether the IPv4 networks of a walk are yielded in IPv6 form
+	empty  bool
+
+	prefix netip.Prefix
+	record []string
+	err    error
+}
+
+// Networks returns an iterator over the networks of the database in
+// address order, IPv4 networks first, then IPv6 networks. Networks
+// without a record are skipped unless IncludeEmpty is set, neighbouring
+// networks with the same record are yielded separately as stored in
+// the file. A search tree with a cycle ends the iteration with
+// ErrDatabaseError.
+func (db *database) Networks(opts NetworksOptions) (*NetworkIterator, error) {
+	if opts.IPv4Only && opts.IPv6Only {
+		return nil, ErrNetworksOptions
+	}
+	language := opts.Language
+	if language == "" {
+		language = "CN"
+	}
+
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	off, ok := r.meta.Languages[language]
+	if !ok {
+		r.release()
+		return nil, ErrNoSupportLanguage
+	}
+
+	it := &NetworkIterator{r: r, off: off, empty: opts.IncludeEmpty}
+	mapped := netip.IPv4Unspecified().As16()
+	if !opts.IPv6Only && r.IsIPv4Support() {
+		it.push(r.walkLeaves(r.v4offset, mapped, 96), false)
+	}
+	if !opts.IPv4Only {
+		switch {
+		case r.IsIPv6Support():
+			w := r.walkLeaves(0, [16]byte{}, 0)
+			w.skip4 = !opts.IncludeIPv4Mapped
+			it.push(w, true)
+		case opts.IncludeIPv4Mapped && r.IsIPv4Support():
+			it.push(r.walkLeaves(r.v4offset, mapped, 96), true)
+		}
+	}
+
+	return it, nil
+}
+
+func (it *NetworkIterator) push(w *leafWalker, mapped bool) {
+	w.empty = it.empty
+	it.walks = append(it.walks, w)
+	it.mapped = append(it.mapped, mapped)
+}
+
+// Next advances to the next network, it returns false when there are
+// no more networks or on error; see Err
+func (it *NetworkIterator) Next() bool {
+	for it.r != nil && len(it.walks) > 0 {
+		leaf, prefix, ok := it.walks[0].next()
+		if !ok {
+			if err := it.walks[0].err; err != nil {
+				it.err = err
+				it.Close()
+				return false
+			}
+			it.walks, it.mapped = it.walks[1:], it.mapped[1:]
+			continue
+		}
+
+		var err error
+		it.record = nil
+		if leaf != it.r.nodeCount {
+			var body []byte
+			body, err = it.r.resolve(leaf)
+			if err == nil {
+				it.record, err = it.r.fieldsInto(leaf, body, it.off, nil)
+			}
+		}
+		if err != nil {
+			it.err = err
+			it.Close()
+			return false
+		}
+
+		if it.mapped[0] && prefix.Addr().Is4() {
+			prefix = netip.PrefixFrom(netip.AddrFrom16(prefix.Addr().As16()), prefix.Bits()+96)
+		}
+		it.prefix = prefix
+		return true
+	}
+
+	it.Close()
+	return false
+}
+
+// Network returns the current network and its record, the record
+// belongs to the caller
+func (it *NetworkIterator) Network() (netip.Prefix, []string) {
+	return it.prefix, it.record
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *NetworkIterator) Err() error {
+	return it.err
+}
+
+// Close stops the iteration early and releases the database, it is
+// safe to call more than once
+func (it *NetworkIterator) Close() error {
+	if it.r != nil {
+		it.r.release()
+		it.r = nil
+		it.walks, it.mapped = nil, nil
+	}
+	return nil
+}
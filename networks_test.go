@@ -0,0 +1,172 @@
+package ipdb
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestNetworks(t *testing.T) {
+	it, err := db.Networks(NetworksOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var count int
+	var addresses uint64
+	var last netip.Prefix
+	for it.Next() {
+		prefix, record := it.Network()
+		if !prefix.Addr().Is4() {
+			t.Fatalf("IPv6 network %s in an IPv4 database", prefix)
+		}
+		if last.IsValid() && (last.Overlaps(prefix) || prefix.Addr().Less(last.Addr())) {
+			t.Fatalf("%s after %s", prefix, last)
+		}
+		last = prefix
+		count++
+		addresses += 1 << uint(32-prefix.Bits())
+
+		if count%1000 == 0 {
+			want, err := db.FindWithNetwork(prefix.Addr().String(), "CN")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want.Prefix != prefix || !equalStrings(want.Record, record) {
+				t.Fatalf("%s: %v, FindWithNetwork %+v", prefix, record, want)
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if addresses != 1<<32 {
+		t.Fatalf("%d networks cover %d addresses", count, addresses)
+	}
+
+	it, err = db.Networks(NetworksOptions{IPv6Only: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() {
+		t.Fatal("IPv6 network in an IPv4 database")
+	}
+
+	it, err = db.Networks(NetworksOptions{IPv6Only: true, IncludeIPv4Mapped: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("no IPv4-mapped network")
+	}
+	if prefix, _ := it.Network(); !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		t.Fatalf("IPv4-mapped network %s", prefix)
+	}
+	it.Close()
+	it.Close()
+
+	if _, err := db.Networks(NetworksOptions{Language: "EN"}); !errors.Is(err, ErrNoSupportLanguage) {
+		t.Fatalf("Networks(EN) = %v", err)
+	}
+	if _, err := db.Networks(NetworksOptions{IPv4Only: true, IPv6Only: true}); !errors.Is(err, ErrNetworksOptions) {
+		t.Fatalf("Networks(IPv4Only, IPv6Only) = %v", err)
+	}
+}
+
+func TestNetworks_Cycle(t *testing.T) {
+	cdb, err := NewCityFromBytes(selfLoopDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []NetworksOptions{{}, {IPv6Only: true, IncludeEmpty: true}} {
+		it, err := cdb.Networks(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for it.Next() {
+		}
+		if err := it.Err(); !errors.Is(err, ErrDatabaseError) {
+			t.Fatalf("Networks(%+v) of a cyclic tree = %v", opts, err)
+		}
+	}
+}
+
+func TestNetworks_IPv6(t *testing.T) {
+	nets := testNetworks{}
+	for _, cidr := range []string{"2001:db8::/32", "1.0.0.0/8", "::ffff:10.0.0.0/104", "2400:cb00::/32"} {
+		nets[cidr] = builderValues(cidr, cidr)
+	}
+	cdb := buildCity(t, []string{"country_name", "city_name"}, nets, "CN", "EN")
+
+	networks := func(opts NetworksOptions) []string {
+		it, err := cdb.Networks(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+
+		var list []string
+		for it.Next() {
+			prefix, record := it.Network()
+			list = append(list, prefix.String()+" "+record[0])
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	for _, c := range []struct {
+		opts NetworksOptions
+		want []string
+	}{
+		{NetworksOptions{Language: "EN"}, []string{
+			"1.0.0.0/8 1.0.0.0/8", "10.0.0.0/8 ::ffff:10.0.0.0/104",
+			"2001:db8::/32 2001:db8::/32", "2400:cb00::/32 2400:cb00::/32",
+		}},
+		{NetworksOptions{IPv4Only: true}, []string{
+			"1.0.0.0/8 1.0.0.0/8", "10.0.0.0/8 ::ffff:10.0.0.0/104",
+		}},
+		{NetworksOptions{IPv6Only: true, IncludeIPv4Mapped: true}, []string{
+			"::ffff:1.0.0.0/104 1.0.0.0/8", "::ffff:10.0.0.0/104 ::ffff:10.0.0.0/104",
+			"2001:db8::/32 2001:db8::/32", "2400:cb00::/32 2400:cb00::/32",
+		}},
+	} {
+		got := networks(c.opts)
+		if !equalStrings(got, c.want) {
+			t.Errorf("Networks(%+v) = %q, want %q", c.opts, got, c.want)
+		}
+	}
+
+	it, err := cdb.Networks(NetworksOptions{IPv4Only: true, IncludeEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses uint64
+	var empty int
+	for it.Next() {
+		prefix, record := it.Network()
+		addresses += 1 << uint(32-prefix.Bits())
+		if record == nil {
+			empty++
+		}
+	}
+	if addresses != 1<<32 || empty == 0 {
+		t.Fatalf("IncludeEmpty networks cover %d addresses, %d empty", addresses, empty)
+	}
+
+	// an iterator keeps its build after Close of the database
+	it, err = cdb.Networks(NetworksOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb.Close()
+	var n int
+	for it.Next() {
+		n++
+	}
+	if n != 4 || it.Err() != nil {
+		t.Fatalf("%d networks after Close, %v", n, it.Err())
+	}
+}
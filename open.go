@@ -0,0 +1,136 @@
+package ipdb
+
+import (
+	"io"
+	"io/fs"
+	"net/netip"
+	"reflect"
+	"time"
+)
+
+// Database is the method set shared by City, IDC, BaseStation, District
+// and Risk, for tooling that accepts any ipdb file
+type Database interface {
+	Decoder
+
+	Find(addr, language string) ([]string, error)
+	FindMap(addr, language string) (map[string]string, error)
+	FindAddr(addr netip.Addr, language string) ([]string, error)
+	FindMapAddr(addr netip.Addr, language string) (map[string]string, error)
+	FindInto(addr, language string, dst []string) ([]string, error)
+	FindFields(addr, language string, fields ...string) ([]string, error)
+	FindWithNetwork(addr, language string) (LookupResult, error)
+
+	Reload(name string) error
+	ReloadFS(fsys fs.FS, name string) error
+	ReloadReader(src io.Reader, size int64) error
+	Close() error
+	Verify() (*VerifyReport, error)
+	Lint() (*LintReport, error)
+	Subset(opts SubsetOptions) (*Builder, error)
+	Networks(opts NetworksOptions) (*NetworkIterator, error)
+
+	IsIPv4() bool
+	IsIPv6() bool
+	Languages() []string
+	Fields() []string
+	BuildTime() time.Time
+	Meta() MetaData
+}
+
+var (
+	_ Database = (*City)(nil)
+	_ Database = (*IDC)(nil)
+	_ Database = (*BaseStation)(nil)
+	_ Database = (*District)(nil)
+	_ Database = (*Risk)(nil)
+)
+
+// Open loads the database at name and returns the handle matching the
+// product it holds, detected from its fields: a *Risk if it has a score,
+// a *District if it has a covering radius, an *IDC or *BaseStation if
+// it has only the fields of IDCInfo or BaseStationInfo, and a *City
+// otherwise.
+func Open(name string, opts ...Option) (Database, error) {
+	o := newOptions(opts)
+
+	r, err := newReader(name, nil, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDatabase(r, o), nil
+}
+
+// OpenBytes is Open for a database in memory
+func OpenBytes(bs []byte) (Database, error) {
+	o := newOptions(nil)
+
+	r, err := newReaderFromBytes(bs, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r, err = o.load(r, nil); err != nil {
+		return nil, err
+	}
+
+	return newDatabase(r, o), nil
+}
+
+func newDatabase(r *reader, opts options) Database {
+	fields := r.meta.Fields
+
+	var db Database
+	var base *database
+	var obj interface{}
+	switch {
+	case hasField(fields, "score"):
+		risk := &Risk{}
+		db, base, obj = risk, &risk.database, &RiskInfo{}
+	case hasField(fields, "covering_radius"):
+		district := &District{}
+		db, base, obj = district, &district.database, &DistrictInfo{}
+	case hasField(fields, "idc") && onlyFieldsOf(fields, IDCInfo{}):
+		idc := &IDC{}
+		db, base, obj = idc, &idc.database, &IDCInfo{}
+	case hasField(fields, "base_station") && onlyFieldsOf(fields, BaseStationInfo{}):
+		bs := &BaseStation{}
+		db, base, obj = bs, &bs.database, &BaseStationInfo{}
+	default:
+		city := &City{}
+		db, base, obj = city, &city.database, &CityInfo{}
+	}
+
+	base.obj = obj
+	base.opts = opts
+	base.cur.Store(r)
+	r.planFor(reflect.TypeOf(obj).Elem())
+
+	return db
+}
+
+func hasField(fields []string, name string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyFieldsOf whether every field is mapped by a field of info
+func onlyFieldsOf(fields []string, info interface{}) bool {
+	t := reflect.TypeOf(info)
+	known := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _ := fieldName(t.Field(i))
+		known[name] = true
+	}
+
+	for _, f := range fields {
+		if !known[f] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package ipdb
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	cn := map[string]int{"CN": 0}
+
+	for _, tc := range []struct {
+		fields []string
+		want   Database
+	}{
+		{[]string{"country_name", "region_name", "city_name"}, &City{}},
+		{[]string{"country_name", "region_name", "city_name", "owner_domain", "isp_domain", "idc"}, &IDC{}},
+		{[]string{"country_name", "region_name", "city_name", "owner_domain", "isp_domain", "base_station"}, &BaseStation{}},
+		{[]string{"country_name", "region_name", "city_name", "district_name", "china_admin_code", "covering_radius", "latitude", "longitude"}, &District{}},
+		{[]string{"score", "behavior", "country_code"}, &Risk{}},
+		{[]string{"country_name", "region_name", "city_name", "idc", "base_station", "latitude"}, &City{}},
+	} {
+		record := make([]byte, 0, 64)
+		for i := range tc.fields {
+			if i > 0 {
+				record = append(record, '\t')
+			}
+			record = append(record, '1')
+		}
+
+		name := filepath.Join(dir, "test.ipdb")
+		writeFile(t, name, singleRecordDB(t, tc.fields, cn, string(record)))
+		got, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.TypeOf(got) != reflect.TypeOf(tc.want) {
+			t.Errorf("Open(%v) = %T, want %T", tc.fields, got, tc.want)
+		}
+		if _, err := got.Find("1.2.3.4", "CN"); err != nil {
+			t.Error(err)
+		}
+		got.Close()
+	}
+
+	city, err := Open("city.free.ipdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := city.(*City).FindInfo("118.28.1.1", "CN")
+	if err != nil || info.CityName == "" {
+		t.Errorf("FindInfo = %+v, %v", info, err)
+	}
+}
+
+func TestOpenBytes(t *testing.T) {
+	risk, err := OpenBytes(singleRecordDB(t, []string{"score", "behavior", "country_code"}, map[string]int{"CN": 0}, "85\tproxy\tUS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := risk.(*Risk); !ok {
+		t.Fatalf("OpenBytes = %T, want *Risk", risk)
+	}
+
+	meta := risk.Meta()
+	if meta.Build != 1000 || meta.IPVersion != 1 || meta.Languages["CN"] != 0 || len(meta.Fields) != 3 {
+		t.Fatalf("Meta = %+v", meta)
+	}
+	// a copy
+	meta.Fields[0] = "x"
+	if risk.Fields()[0] != "score" {
+		t.Fatal("Meta shares the fields")
+	}
+
+	if _, err := OpenBytes([]byte{0, 0}); !errors.Is(err, ErrFileSize) {
+		t.Fatalf("OpenBytes(short) = %v", err)
+	}
+}
+
+func TestNewRiskFromBytes(t *testing.T) {
+	r, err := NewRiskFromBytes(singleRecordDB(t,
+		[]string{"score", "behavior", "country_code"}, map[string]int{"CN": 0}, "85\tproxy\tUS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := r.FindInfo("1.2.3.4")
+	if err != nil || *info != (RiskInfo{Score: 85, Behavior: "proxy", CountryCode: "US"}) {
+		t.Errorf("FindInfo = %+v, %v", info, err)
+	}
+	if !r.IsIPv4() || r.IsIPv6() || len(r.Fields()) != 3 || r.BuildTime().Unix() != 1000 {
+		t.Errorf("metadata = %v %v %v %v", r.IsIPv4(), r.IsIPv6(), r.Fields(), r.BuildTime())
+	}
+}
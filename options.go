@@ -0,0 +1,115 @@
+package ipdb
+
+// Option configures how a database is loaded
+type Option func(*options)
+
+type options struct {
+	mmap      bool
+	languages []string
+	fields    []string
+	strict    bool
+	cacheSize int
+	jumpBits  int
+}
+
+func newOptions(opts []Option) options {
+	o := options{jumpBits: defaultJumpBits}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMmap maps the database file into memory instead of reading it onto
+// the heap, so processes opening the same file share its pages.
+// Lookups return copies of the record, so results stay valid after
+// Reload or Close unmaps the file.
+// On platforms without mmap support the file is read as usual.
+//
+// The file must not be modified in place while it is mapped: write the
+// new version to another file and rename it over the old one, then
+// Reload. A lookup reaching a part of the file truncated under it fails
+// with ErrDatabaseError instead of crashing the process, but content
+// rewritten in place is read as is, and Verify, Lint, Networks, Subset
+// and Diff are not protected.
+func WithMmap() Option {
+	return func(o *options) {
+		o.mmap = true
+	}
+}
+
+// WithLanguages keeps only the records of languages, in this order,
+// when the database is loaded or reloaded. The other languages are
+// dropped from the records, saving memory and the time to skip them on
+// every lookup. Loading fails with ErrNoSupportLanguage if the file
+// lacks one of them.
+func WithLanguages(languages ...string) Option {
+	return func(o *options) {
+		o.languages = languages
+	}
+}
+
+// WithFields keeps only fields, in this order, when the database is
+// loaded or reloaded; Fields and the lookups return these alone.
+// Loading fails with ErrNoSupportField if the file lacks one of them.
+func WithFields(fields ...string) Option {
+	return func(o *options) {
+		o.fields = fields
+	}
+}
+
+// WithStrict validates every node and record of the file when it is
+// loaded, as Reload always does, so that no lookup can fail with
+// ErrDatabaseError later on.
+func WithStrict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// WithCacheSize caches the search tree walks of up to n recently
+// queried addresses, for workloads that query the same addresses over
+// and over. It pays off for IPv6 addresses, whose walks are long; IPv4
+// addresses are only cached if WithIPv4JumpTable(0) disables the jump
+// table, which finds them as fast. The cache is emptied on Reload.
+// 0 disables it.
+func WithCacheSize(n int) Option {
+	return func(o *options) {
+		o.cacheSize = n
+	}
+}
+
+// WithIPv4JumpTable sets the number of leading bits of an IPv4 address,
+// 16 by default and at most 24, that a table built at load time
+// resolves at once, so that lookups walk the search tree from there.
+// The table takes 5 bytes per entry, 2^bits entries. 0 disables it.
+func WithIPv4JumpTable(bits int) Option {
+	return func(o *options) {
+		o.jumpBits = bits
+	}
+}
+
+// load applies the options that act on a loaded file to r
+func (o options) load(r *reader, obj interface{}) (*reader, error) {
+	if len(o.languages) > 0 || len(o.fields) > 0 {
+		p, err := r.project(o.languages, o.fields, obj)
+		r.close()
+		if err != nil {
+			return nil, err
+		}
+		r = p
+	}
+	if o.strict && !r.validated {
+		if err := r.validate(); err != nil {
+			r.close()
+			return nil, err
+		}
+		r.validated = true
+	}
+	if o.cacheSize > 0 {
+		r.cache = newLookupCache(o.cacheSize)
+	}
+	r.jump = r.buildJumpTable(o.jumpBits)
+
+	return r, nil
+}
@@ -0,0 +1,238 @@
+package ipdb
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithFields(t *testing.T) {
+	body := buildBytes(t, []string{"country_name", "region_name", "city_name"}, testNetworks{
+		"1.0.0.0/8":     {"CN": {"中国", "北京", "北京"}, "EN": {"China", "Beijing", "Beijing"}},
+		"2.0.0.0/8":     {"CN": {"中国", "北京", "北京"}, "EN": {"China", "Beijing", "Beijing2"}},
+		"2001:db8::/32": {"CN": {"美国", "加州", "洛杉矶"}, "EN": {"United States", "California", "Los Angeles"}},
+	}, "CN", "EN")
+
+	cdb, err := OpenCityReader(bytes.NewReader(body), -1, WithLanguages("EN"), WithFields("city_name", "country_name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := cdb.Languages(); len(l) != 1 || l[0] != "EN" {
+		t.Fatalf("Languages = %v", l)
+	}
+	if f := cdb.Fields(); !equalStrings(f, []string{"city_name", "country_name"}) {
+		t.Fatalf("Fields = %v", f)
+	}
+	if cdb.Meta().TotalSize >= len(body) {
+		t.Fatalf("projected size %d, original %d", cdb.Meta().TotalSize, len(body))
+	}
+
+	for addr, want := range map[string][]string{
+		"1.2.3.4":     {"Beijing", "China"},
+		"2.2.3.4":     {"Beijing2", "China"},
+		"2001:db8::1": {"Los Angeles", "United States"},
+	} {
+		got, err := cdb.Find(addr, "EN")
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		if !equalStrings(got, want) {
+			t.Errorf("Find(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	info, err := cdb.FindInfo("2001:db8::1", "EN")
+	if err != nil || info.CityName != "Los Angeles" || info.RegionName != "" {
+		t.Fatalf("FindInfo = %+v, %v", info, err)
+	}
+	if _, err := cdb.Find("1.2.3.4", "CN"); !errors.Is(err, ErrNoSupportLanguage) {
+		t.Fatalf("Find(CN) = %v", err)
+	}
+	report, err := cdb.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the records of 1.0.0.0/8 and 2.0.0.0/8 still differ
+	if report.Records != 3 || report.ReachableNodes != report.NodeCount {
+		t.Fatalf("Verify = %+v", report)
+	}
+
+	// the CN records of 1.0.0.0/8 and 2.0.0.0/8 become one
+	cdb, err = OpenCityReader(bytes.NewReader(body), -1, WithLanguages("CN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err := cdb.Verify(); err != nil || report.Records != 2 {
+		t.Fatalf("Verify = %+v, %v", report, err)
+	}
+
+	if _, err := OpenCityReader(bytes.NewReader(body), -1, WithLanguages("JP")); !errors.Is(err, ErrNoSupportLanguage) {
+		t.Fatalf("WithLanguages(JP) = %v", err)
+	}
+	if _, err := OpenCityReader(bytes.NewReader(body), -1, WithFields("city_name", "city_name")); !errors.Is(err, ErrNoSupportField) {
+		t.Fatalf("WithFields(city_name, city_name) = %v", err)
+	}
+}
+
+func TestWithFields_Reload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+
+	for _, opts := range [][]Option{{WithFields("city_name")}, {WithFields("city_name"), WithMmap()}} {
+		cdb, err := OpenCity(name, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range []string{"118.28.1.1", "1.1.1.1", "36.102.4.81"} {
+			want, err := db.FindMap(addr, "CN")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cdb.Find(addr, "CN")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0] != want["city_name"] {
+				t.Errorf("Find(%s) = %v, want %s", addr, got, want["city_name"])
+			}
+		}
+
+		if err := cdb.Reload(name); err != nil {
+			t.Fatal(err)
+		}
+		if f := cdb.Fields(); len(f) != 1 || f[0] != "city_name" {
+			t.Fatalf("Fields after Reload = %v", f)
+		}
+		cdb.Close()
+	}
+}
+
+func TestWithStrict(t *testing.T) {
+	// a record with two fields of three
+	body := singleRecordDB(t, []string{"score", "behavior", "country_code"}, map[string]int{"CN": 0}, "85\tproxy")
+
+	if _, err := OpenRiskReader(bytes.NewReader(body), -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenRiskReader(bytes.NewReader(body), -1, WithStrict()); !errors.Is(err, ErrDatabaseError) {
+		t.Fatalf("WithStrict = %v", err)
+	}
+
+	plain, err := os.ReadFile("city.free.ipdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCityReader(bytes.NewReader(plain), -1, WithStrict()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cachedAddrs(c *lookupCache) int {
+	n := 0
+	for i := range c.slots {
+		if c.slots[i].Load() != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWithCacheSize(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+
+	// the jump table would serve IPv4 without the cache
+	jdb, err := OpenCity(name, WithCacheSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jdb.Close()
+	if _, err := jdb.Find("118.28.1.1", "CN"); err != nil {
+		t.Fatal(err)
+	}
+	if n := cachedAddrs(jdb.current().cache); n != 0 {
+		t.Fatalf("cache holds %d IPv4 addresses with the jump table", n)
+	}
+
+	cdb, err := OpenCity(name, WithCacheSize(2), WithIPv4JumpTable(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+
+	for i := 0; i < 3; i++ {
+		for _, addr := range []string{"118.28.1.1", "1.1.1.1", "::ffff:36.102.4.81"} {
+			want, err := db.FindWithNetwork(addr, "CN")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cdb.FindWithNetwork(addr, "CN")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Prefix != want.Prefix || !equalStrings(got.Record, want.Record) {
+				t.Fatalf("FindWithNetwork(%s) = %+v, want %+v", addr, got, want)
+			}
+		}
+	}
+	cache := cdb.current().cache
+	if n := cachedAddrs(cache); n == 0 || n > 2 {
+		t.Fatalf("cache holds %d addresses", n)
+	}
+	// the last address looked up is in its slot
+	if _, _, prefix, ok := cache.get(netip.MustParseAddr("36.102.4.81")); !ok || !prefix.Contains(netip.MustParseAddr("36.102.4.81")) {
+		t.Fatalf("cache get = %v, %v", prefix, ok)
+	}
+
+	if err := cdb.Reload(name); err != nil {
+		t.Fatal(err)
+	}
+	if n := cachedAddrs(cdb.current().cache); n != 0 {
+		t.Fatalf("cache holds %d addresses after Reload", n)
+	}
+	if _, err := cdb.Find("2001:db8::1", "CN"); !errors.Is(err, ErrNoSupportIPv6) {
+		t.Fatalf("Find(IPv6) = %v", err)
+	}
+}
+
+func BenchmarkCity_FindInto_Cache(b *testing.B) {
+	// 50000 IPv6 networks, queried 500 at a time
+	rnd := rand.New(rand.NewSource(1))
+	networks := testNetworks{}
+	var addrs []string
+	for i := 0; i < 50000; i++ {
+		var a [16]byte
+		rnd.Read(a[:8])
+		a[0] = 0x24
+		p := netip.PrefixFrom(netip.AddrFrom16(a), 48+rnd.Intn(17)).Masked()
+		networks[p.String()] = map[string][]string{"CN": {"中国", "北京", p.String()}}
+		if i%100 == 0 {
+			addrs = append(addrs, p.Addr().Next().String())
+		}
+	}
+	body := buildBytes(b, []string{"country_name", "region_name", "city_name"}, networks)
+
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"NoCache", nil},
+		{"Cache", []Option{WithCacheSize(4096)}},
+	} {
+		cdb, err := OpenCityReader(bytes.NewReader(body), -1, c.opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				dst := make([]string, 0, 3)
+				for i := 0; pb.Next(); i++ {
+					dst, _ = cdb.FindInto(addrs[i%len(addrs)], "CN", dst)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package ipdb
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SourceBase is the source of a field of an OverlayResult taken from the
+// base database
+const SourceBase = "base"
+
+var ErrCorrections = errors.New("corrections file error")
+
+// Correction overrides fields of the base database for a network
+type Correction struct {
+	Prefix netip.Prefix `json:"prefix"`
+	// Language the correction applies to, every language if empty
+	Language string            `json:"language,omitempty"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// OverlayResult is a record of the base database with the corrections
+// merged over it
+type OverlayResult struct {
+	Record []string `json:"record"`
+	// Sources holds the source of each value of Record: SourceBase, or
+	// the prefix of the correction that set it, such as 10.0.0.0/8
+	Sources []string `json:"sources"`
+}
+
+// Overlay wraps a database with local corrections. A lookup returns the
+// record of the base database where each field is replaced by the
+// value of the most specific correction containing the address that
+// sets this field. Corrections also apply to addresses the base
+// database has no data for, over a record of empty values; such a
+// lookup only returns ErrDataNotExists if no correction sets a field.
+// The corrections reload independently of the base database.
+type Overlay struct {
+	base  Database
+	cur   atomic.Pointer[corrections]
+	plans sync.Map // reflect.Type -> *decodePlan
+}
+
+// corrections holds the corrections by prefix length, longest first
+type corrections struct {
+	bits     []int
+	prefixes map[netip.Prefix][]Correction
+	count    int
+}
+
+// NewOverlay wraps base with the corrections in the file name, a JSON
+// file if its name ends with .json and a CSV file otherwise; see
+// ReadCorrections
+func NewOverlay(base Database, name string) (*Overlay, error) {
+	o := &Overlay{base: base}
+	if err := o.Reload(name); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// NewOverlayCorrections wraps base with corrections
+func NewOverlayCorrections(base Database, list []Correction) (*Overlay, error) {
+	o := &Overlay{base: base}
+	c, err := o.index(list)
+	if err != nil {
+		return nil, err
+	}
+	o.cur.Store(c)
+
+	return o, nil
+}
+
+// Reload replaces the corrections with those of the file name, the base
+// database is left as is
+func (o *Overlay) Reload(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	list, err := ReadCorrections(f, strings.HasSuffix(strings.ToLower(name), ".json"))
+	if err != nil {
+		return err
+	}
+	c, err := o.index(list)
+	if err != nil {
+		return err
+	}
+	o.cur.Store(c)
+
+	return nil
+}
+
+// ReadCorrections reads corrections in JSON, an array of Correction,
+// or in CSV. The first CSV line names the columns: prefix, an optional
+// language, and the fields to override; empty cells override nothing.
+// Lines starting with # are comments. A prefix may be a single address.
+func ReadCorrections(r io.Reader, isJSON bool) ([]Correction, error) {
+	if isJSON {
+		var list []Correction
+		if err := json.NewDecoder(r).Decode(&list); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrections, err)
+		}
+		return list, nil
+	}
+
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrections, err)
+	}
+	if len(header) < 2 || strings.TrimSpace(header[0]) != "prefix" {
+		return nil, fmt.Errorf("%w: first column must be prefix", ErrCorrections)
+	}
+
+	var list []Correction
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrections, err)
+		}
+
+		prefix, err := parsePrefix(strings.TrimSpace(row[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrections, err)
+		}
+		c := Correction{Prefix: prefix, Fields: make(map[string]string)}
+		for i := 1; i < len(header); i++ {
+			name, v := strings.TrimSpace(header[i]), strings.TrimSpace(row[i])
+			switch {
+			case name == "language":
+				c.Language = v
+			case v != "":
+				c.Fields[name] = v
+			}
+		}
+		list = append(list, c)
+	}
+
+	return list, nil
+}
+
+// index checks list against the base database and indexes it
+func (o *Overlay) index(list []Correction) (*corrections, error) {
+	c := &corrections{prefixes: make(map[netip.Prefix][]Correction), count: len(list)}
+	fields := o.base.Fields()
+	languages := o.base.Languages()
+
+	for _, corr := range list {
+		if !corr.Prefix.IsValid() {
+			return nil, fmt.Errorf("%w: invalid prefix", ErrCorrections)
+		}
+		if corr.Language != "" && !hasField(languages, corr.Language) {
+			return nil, fmt.Errorf("%w: %s: %v %s", ErrCorrections, corr.Prefix, ErrNoSupportLanguage, corr.Language)
+		}
+		for f := range corr.Fields {
+			if !hasField(fields, f) {
+				return nil, fmt.Errorf("%w: %s: %v %s", ErrCorrections, corr.Prefix, ErrNoSupportField, f)
+			}
+		}
+
+		p := corr.Prefix.Masked()
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		corr.Prefix = p
+		if _, ok := c.prefixes[p]; !ok && !containsInt(c.bits, p.Bits()) {
+			c.bits = append(c.bits, p.Bits())
+		}
+		c.prefixes[p] = append(c.prefixes[p], corr)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(c.bits)))
+	// a correction for the language wins over one for every language
+	for _, list := range c.prefixes {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Language != "" && list[j].Language == ""
+		})
+	}
+
+	return c, nil
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Corrections returns the number of corrections loaded
+func (o *Overlay) Corrections() int {
+	return o.cur.Load().count
+}
+
+// Base returns the wrapped database
+func (o *Overlay) Base() Database {
+	return o.base
+}
+
+// Fields return support fields
+func (o *Overlay) Fields() []string {
+	return o.base.Fields()
+}
+
+// Languages return support languages
+func (o *Overlay) Languages() []string {
+	return o.base.Languages()
+}
+
+// Find query with addr, the corrections merged over the base record
+func (o *Overlay) Find(addr, language string) ([]string, error) {
+	res, err := o.FindWithSources(addr, language)
+	if err != nil {
+		return nil, err
+	}
+	return res.Record, nil
+}
+
+// FindMap query with addr
+func (o *Overlay) FindMap(addr, language string) (map[string]string, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, fields, err := o.findWithSources(ip, language)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string, len(fields))
+	for i, f := range fields {
+		if i < len(res.Record) {
+			info[f] = res.Record[i]
+		}
+	}
+	return info, nil
+}
+
+// FindWithSources query with addr, together with the source of every
+// field
+func (o *Overlay) FindWithSources(addr, language string) (OverlayResult, error) {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return OverlayResult{}, err
+	}
+
+	return o.FindAddrWithSources(ip, language)
+}
+
+// FindAddrWithSources is FindWithSources with a parsed address
+func (o *Overlay) FindAddrWithSources(addr netip.Addr, language string) (OverlayResult, error) {
+	res, _, err := o.findWithSources(addr, language)
+	return res, err
+}
+
+// lookup returns the base record of addr together with the fields of
+// the build it was read from, so that a Reload of the base database
+// can not pair the record with the fields of another build
+func (o *Overlay) lookup(addr netip.Addr, language string) ([]string, []string, error) {
+	a, ok := o.base.(acquirer)
+	if !ok {
+		record, err := o.base.FindAddr(addr, language)
+		return record, o.base.Fields(), err
+	}
+
+	r, err := a.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.release()
+
+	record, err := r.find1Addr(addr, language)
+	return record, r.meta.Fields, err
+}
+
+// findWithSources is FindAddrWithSources, also returning the fields of
+// the record
+func (o *Overlay) findWithSources(addr netip.Addr, language string) (OverlayResult, []string, error) {
+	record, fields, err := o.lookup(addr, language)
+	missing := errors.Is(err, ErrDataNotExists)
+	if missing {
+		record = make([]string, len(fields))
+	} else if err != nil {
+		return OverlayResult{}, nil, err
+	}
+
+	res := OverlayResult{Record: record, Sources: make([]string, len(record))}
+	for i := range res.Sources {
+		res.Sources[i] = SourceBase
+	}
+
+	c := o.cur.Load()
+	if c.count == 0 {
+		if missing {
+			return OverlayResult{}, nil, err
+		}
+		return res, fields, nil
+	}
+
+	addr = addr.Unmap()
+	set := 0
+	for _, bits := range c.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		for _, corr := range c.prefixes[p] {
+			if corr.Language != "" && corr.Language != language {
+				continue
+			}
+			for i, f := range fields {
+				if i >= len(record) || res.Sources[i] != SourceBase {
+					continue
+				}
+				if v, ok := corr.Fields[f]; ok {
+					res.Record[i] = v
+					res.Sources[i] = p.String()
+					set++
+				}
+			}
+		}
+		if set == len(record) {
+			break
+		}
+	}
+	if missing && set == 0 {
+		return OverlayResult{}, nil, err
+	}
+
+	return res, fields, nil
+}
+
+// Decode queries addr and decodes the fields of language, corrections
+// merged, into the struct pointed to by v; see FindAs
+func (o *Overlay) Decode(addr, language string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrDecodeTarget
+	}
+
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return err
+	}
+	res, fields, err := o.findWithSources(ip, language)
+	if err != nil {
+		return err
+	}
+
+	return o.planFor(rv.Elem().Type(), fields).decode(rv.UnsafePointer(), res.Record)
+}
+
+// planFor returns the decode plan of t for fields, those of the build of
+// the base database a record was read from
+func (o *Overlay) planFor(t reflect.Type, fields []string) *decodePlan {
+	if plan, ok := o.plans.Load(t); ok && equalStrings(plan.(*decodePlan).names, fields) {
+		return plan.(*decodePlan)
+	}
+	plan := newDecodePlan(t, fields)
+	o.plans.Store(t, plan)
+
+	return plan
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package ipdb
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	base := buildCity(t, []string{"country_code", "city_name"}, testNetworks{
+		"10.0.0.0/8":    {"CN": {"US", "纽约"}},
+		"2001:db8::/32": {"CN": {"JP", "东京"}},
+	})
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "corrections.csv")
+	writeFile(t, name, []byte(`prefix,country_code,city_name
+# corporate network
+10.1.0.0/16,CN,北京
+10.1.2.0/24,,上海
+10.1.2.3,,
+2001:db8:1::/48,,大阪
+`))
+
+	o, err := NewOverlay(base, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Corrections() != 4 {
+		t.Fatalf("Corrections = %d", o.Corrections())
+	}
+
+	for _, c := range []struct {
+		addr    string
+		record  []string
+		sources []string
+	}{
+		{"10.0.0.1", []string{"US", "纽约"}, []string{SourceBase, SourceBase}},
+		{"10.1.0.1", []string{"CN", "北京"}, []string{"10.1.0.0/16", "10.1.0.0/16"}},
+		{"10.1.2.3", []string{"CN", "上海"}, []string{"10.1.0.0/16", "10.1.2.0/24"}},
+		{"::ffff:10.1.2.4", []string{"CN", "上海"}, []string{"10.1.0.0/16", "10.1.2.0/24"}},
+		{"2001:db8:1::1", []string{"JP", "大阪"}, []string{SourceBase, "2001:db8:1::/48"}},
+	} {
+		res, err := o.FindWithSources(c.addr, "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Record, c.record) || !reflect.DeepEqual(res.Sources, c.sources) {
+			t.Errorf("FindWithSources(%s) = %+v, want %v %v", c.addr, res, c.record, c.sources)
+		}
+	}
+
+	info, err := FindAs[CityInfo](o, "10.1.2.3", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CountryCode != "CN" || info.CityName != "上海" {
+		t.Fatalf("FindAs = %+v", info)
+	}
+
+	// reloading the corrections leaves the base as is
+	name = filepath.Join(dir, "corrections.json")
+	writeFile(t, name, []byte(`[
+		{"prefix": "10.0.0.0/8", "language": "CN", "fields": {"city_name": "旧金山"}},
+		{"prefix": "10.0.0.0/8", "fields": {"city_name": "洛杉矶"}}
+	]`))
+	if err := o.Reload(name); err != nil {
+		t.Fatal(err)
+	}
+	res, err := o.FindMap("10.1.2.3", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["country_code"] != "US" || res["city_name"] != "旧金山" {
+		t.Fatalf("FindMap after Reload = %v", res)
+	}
+
+	writeFile(t, name, []byte(`[{"prefix": "10.0.0.0/8", "fields": {"isp_domain": "x"}}]`))
+	if err := o.Reload(name); !errors.Is(err, ErrCorrections) {
+		t.Fatalf("Reload with unknown field = %v", err)
+	}
+	if o.Corrections() != 2 {
+		t.Fatalf("Corrections after failed Reload = %d", o.Corrections())
+	}
+}
+
+func TestOverlay_BaseReload(t *testing.T) {
+	// the same network in two builds with the fields in another order
+	builds := [2][]byte{
+		buildBytes(t, []string{"country_code", "city_name"}, testNetworks{"10.0.0.0/8": {"CN": {"US", "纽约"}}}),
+		buildBytes(t, []string{"city_name", "country_code"}, testNetworks{"10.0.0.0/8": {"CN": {"纽约", "US"}}}),
+	}
+
+	base, err := NewCityFromBytes(builds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewOverlayCorrections(base, []Correction{
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Fields: map[string]string{"city_name": "北京"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := base.ReloadReader(bytes.NewReader(builds[i%2]), -1); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200000; i++ {
+		res, err := o.FindMap("10.1.2.3", "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res["country_code"] != "US" || res["city_name"] != "北京" {
+			t.Errorf("FindMap during base Reload = %v", res)
+			break
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestOverlay_MissingBase(t *testing.T) {
+	base := buildCity(t, []string{"country_code", "city_name"}, testNetworks{
+		"1.0.0.0/8": {"CN": {"CN", "北京"}},
+	})
+	o, err := NewOverlayCorrections(base, []Correction{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Fields: map[string]string{"city_name": "内网"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the correction applies over an empty record
+	res, err := o.FindWithSources("10.1.2.3", "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Record, []string{"", "内网"}) || !reflect.DeepEqual(res.Sources, []string{SourceBase, "10.0.0.0/8"}) {
+		t.Errorf("FindWithSources = %+v", res)
+	}
+	if m, err := o.FindMap("10.1.2.3", "CN"); err != nil || m["city_name"] != "内网" || m["country_code"] != "" {
+		t.Errorf("FindMap = %v, %v", m, err)
+	}
+
+	// without a correction the base error stands
+	if _, err := o.Find("11.0.0.1", "CN"); !errors.Is(err, ErrDataNotExists) {
+		t.Errorf("Find outside the corrections = %v, want ErrDataNotExists", err)
+	}
+	if _, err := o.Find("10.1.2.3", "EN"); !errors.Is(err, ErrNoSupportLanguage) {
+		t.Errorf("Find unsupported language = %v, want ErrNoSupportLanguage", err)
+	}
+}
@@ -0,0 +1,116 @@
+package ipdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+)
+
+// project returns a copy of r holding only languages and fields, in
+// this order, all of them if empty. The node table is kept as is and
+// every record is rewritten once; records that become identical are
+// stored once. The copy is fully validated.
+func (r *reader) project(languages, fields []string, obj interface{}) (*reader, error) {
+	if len(languages) == 0 {
+		languages = r.Languages()
+		sort.Slice(languages, func(i, j int) bool {
+			return r.meta.Languages[languages[i]] < r.meta.Languages[languages[j]]
+		})
+	}
+	offs := make([]int, len(languages))
+	for i, language := range languages {
+		off, ok := r.meta.Languages[language]
+		if !ok || hasField(languages[:i], language) {
+			return nil, ErrNoSupportLanguage
+		}
+		offs[i] = off
+	}
+
+	if len(fields) == 0 {
+		fields = r.meta.Fields
+	}
+	index := make([]int, len(fields))
+	for i, f := range fields {
+		n, ok := r.fieldIndex[f]
+		if !ok || hasField(fields[:i], f) {
+			return nil, ErrNoSupportField
+		}
+		index[i] = n
+	}
+
+	nodes := r.nodeCount * 8
+	data := make([]byte, nodes+16, len(r.data))
+	copy(data, r.data[:nodes])
+
+	moved := make(map[int]uint32)     // old pointer -> new pointer
+	stored := make(map[string]uint32) // record -> new pointer
+	var buf []string
+	var record []byte
+	for i := 0; i < r.nodeCount*2; i++ {
+		ptr := r.readNode(i>>1, i&1)
+		if ptr <= r.nodeCount {
+			continue
+		}
+
+		to, ok := moved[ptr]
+		if !ok {
+			body, err := r.resolve(ptr)
+			if err != nil {
+				return nil, err
+			}
+			record = record[:0]
+			for k, off := range offs {
+				if buf, err = r.fieldsInto(ptr, body, off, buf); err != nil {
+					return nil, err
+				}
+				for j, n := range index {
+					if k > 0 || j > 0 {
+						record = append(record, '\t')
+					}
+					record = append(record, buf[n]...)
+				}
+			}
+
+			if to, ok = stored[string(record)]; !ok {
+				// a pointer resolves to pointer - node_count + node_count*8
+				to = uint32(len(data) - nodes + r.nodeCount)
+				data = binary.BigEndian.AppendUint16(data, uint16(len(record)))
+				data = append(data, record...)
+				stored[string(record)] = to
+			}
+			moved[ptr] = to
+		}
+		binary.BigEndian.PutUint32(data[i*4:], to)
+	}
+
+	offsets := make(map[string]int, len(languages))
+	for i, language := range languages {
+		offsets[language] = i * len(fields)
+	}
+	meta, err := json.Marshal(MetaData{
+		Build:     r.meta.Build,
+		IPVersion: r.meta.IPVersion,
+		Languages: offsets,
+		NodeCount: r.nodeCount,
+		TotalSize: len(data),
+		Fields:    fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Grow(4 + len(meta) + len(data))
+	binary.Write(&out, binary.BigEndian, uint32(len(meta)))
+	out.Write(meta)
+	out.Write(data)
+
+	p, err := initBytes(out.Bytes(), obj)
+	if err != nil {
+		return nil, err
+	}
+	p.validated = true
+
+	return p, nil
+}
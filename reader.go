@@ -1,14 +1,20 @@
 package ipdb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"net"
+	"math"
+	"net/netip"
 	"os"
 	"reflect"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -26,12 +32,48 @@ var (
 	ErrIPFormat = errors.New("Query IP Format error.")
 
 	ErrNoSupportLanguage = errors.New("language not support")
+	ErrNoSupportField    = errors.New("field not support")
 	ErrNoSupportIPv4     = errors.New("IPv4 not support")
 	ErrNoSupportIPv6     = errors.New("IPv6 not support")
 
 	ErrDataNotExists = errors.New("data is not exists")
+
+	ErrDecodeTarget = errors.New("decode target must be a non-nil pointer to a struct")
+
+	ErrDatabaseClosed = errors.New("database is closed")
+	ErrSnapshotReload = errors.New("snapshot can not be reloaded")
 )
 
+// FormatError describes where and why a database file is malformed.
+// It unwraps to ErrFileSize, ErrMetaData or ErrDatabaseError.
+type FormatError struct {
+	// Offset in the file of the malformed data, -1 if unknown
+	Offset int
+	// Node of the search tree that led to it, -1 if none
+	Node   int
+	Reason string
+	Err    error
+}
+
+func (e *FormatError) Error() string {
+	s := e.Err.Error() + " " + e.Reason
+	if e.Node >= 0 {
+		s += " (node " + strconv.Itoa(e.Node) + ")"
+	}
+	if e.Offset >= 0 {
+		s += " (offset " + strconv.Itoa(e.Offset) + ")"
+	}
+	return s
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+func formatError(err error, offset, node int, reason string) error {
+	return &FormatError{Offset: offset, Node: node, Reason: reason, Err: err}
+}
+
 type MetaData struct {
 	Build     int64          `json:"build"`
 	IPVersion uint16         `json:"ip_version"`
@@ -41,18 +83,60 @@ type MetaData struct {
 	Fields    []string       `json:"fields"`
 }
 
+// LookupResult is the record of an address together with the network
+// the record applies to, every address in Prefix has the same record
+type LookupResult struct {
+	Prefix netip.Prefix
+	Record []string
+}
+
 type reader struct {
 	fileSize  int
 	nodeCount int
 	v4offset  int
 
+	// dataOffset is the file offset of data, used in errors
+	dataOffset int
+
 	meta MetaData
 	data []byte
 
-	refType map[string]string
+	plans      sync.Map // reflect.Type -> *decodePlan
+	fieldIndex map[string]int
+	// bufs holds scratch slices with room for every field, see fieldBuf
+	bufs sync.Pool
+
+	// unmap releases a memory-mapped file, nil when data is on the heap
+	unmap func() error
+
+	// validated is set once every node and record was checked
+	validated bool
+	// closed marks the reader Close leaves in place of the content
+	closed bool
+	// cache holds recent lookups, nil unless WithCacheSize
+	cache *lookupCache
+	// jump starts IPv4 searches below the root, nil if disabled
+	jump *jumpTable
+
+	// refs counts the database handle plus every in-flight lookup and
+	// snapshot; the content is released when it drops to zero
+	refs atomic.Int32
+}
+
+func newReader(name string, obj interface{}, opts options) (*reader, error) {
+	r, err := readFile(name, obj, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.load(r, obj)
 }
 
-func newReader(name string, obj interface{}) (*reader, error) {
+func readFile(name string, obj interface{}, opts options) (*reader, error) {
+	if opts.mmap {
+		return newMmapReader(name, obj)
+	}
+
 	var err error
 	var fileInfo os.FileInfo
 	fileInfo, err = os.Stat(name)
@@ -61,58 +145,105 @@ func newReader(name string, obj interface{}) (*reader, error) {
 	}
 	fileSize := int(fileInfo.Size())
 	if fileSize < 4 {
-		return nil, ErrFileSize
+		return nil, formatError(ErrFileSize, fileSize, -1, "file too short for the metadata length")
 	}
 	body, err := ioutil.ReadFile(name)
 	if err != nil {
 		return nil, ErrReadFull
 	}
 
-	return initBytes(body, fileSize, obj)
+	return newReaderFromBytes(body, obj)
+}
+
+func newMmapReader(name string, obj interface{}) (*reader, error) {
+	body, unmap, err := mmapFile(name)
+	if err != nil {
+		return nil, err
+	}
+	// a compressed file can not be used in place
+	if isCompressed(body) {
+		if unmap != nil {
+			defer unmap()
+		}
+		return newReaderFromBytes(body, obj)
+	}
+
+	db, err := initBytes(body, obj)
+	if err != nil {
+		if unmap != nil {
+			unmap()
+		}
+		return nil, err
+	}
+	db.unmap = unmap
+
+	return db, nil
 }
 
+// newReaderFromBytes loads body, decompressed first if it is gzip or
+// zstd framed
 func newReaderFromBytes(body []byte, obj interface{}) (*reader, error) {
-	if len(body) < 4 {
-		return nil, ErrFileSize
+	data, err := decompress(body)
+	if err != nil {
+		return nil, formatError(ErrDatabaseError, -1, -1, "can not decompress the file: "+err.Error())
 	}
-	return initBytes(body, len(body), obj)
+
+	return initBytes(data, obj)
 }
 
-func initBytes(body []byte, fileSize int, obj interface{}) (*reader, error) {
+// initBytes parses the header of body and checks every offset that
+// lookups rely on, so that no lookup can index outside of body
+func initBytes(body []byte, obj interface{}) (*reader, error) {
+	fileSize := len(body)
+	if fileSize < 4 {
+		return nil, formatError(ErrFileSize, fileSize, -1, "file too short for the metadata length")
+	}
+
 	var meta MetaData
 	metaLength := int(binary.BigEndian.Uint32(body[0:4]))
-	if fileSize < (4 + metaLength) {
-		return nil, ErrFileSize
+	if metaLength > fileSize-4 {
+		return nil, formatError(ErrFileSize, 0, -1, "metadata length "+strconv.Itoa(metaLength)+" beyond end of file")
 	}
 	if err := json.Unmarshal(body[4:4+metaLength], &meta); err != nil {
-		return nil, err
+		return nil, formatError(ErrMetaData, 4, -1, err.Error())
 	}
 	if len(meta.Languages) == 0 || len(meta.Fields) == 0 {
-		return nil, ErrMetaData
-	}
-	if fileSize != (4 + metaLength + meta.TotalSize) {
-		return nil, ErrFileSize
+		return nil, formatError(ErrMetaData, 4, -1, "no languages or fields")
 	}
-
-	var dm map[string]string
-	if obj != nil {
-		t := reflect.TypeOf(obj).Elem()
-		dm = make(map[string]string, t.NumField())
-		for i := 0; i < t.NumField(); i++ {
-			k := t.Field(i).Tag.Get("json")
-			dm[k] = t.Field(i).Name
+	for language, off := range meta.Languages {
+		if off < 0 || off > math.MaxInt32 {
+			return nil, formatError(ErrMetaData, 4, -1, "offset of language "+language+" out of range")
 		}
 	}
+	if fileSize-4-metaLength != meta.TotalSize {
+		return nil, formatError(ErrFileSize, 4+metaLength, -1, "total_size "+strconv.Itoa(meta.TotalSize)+" does not match the file")
+	}
+	if meta.NodeCount <= 0 || meta.NodeCount > meta.TotalSize/8 {
+		return nil, formatError(ErrMetaData, 4+metaLength, -1, "node_count "+strconv.Itoa(meta.NodeCount)+" out of range")
+	}
 
 	db := &reader{
-		fileSize:  fileSize,
-		nodeCount: meta.NodeCount,
+		fileSize:   fileSize,
+		nodeCount:  meta.NodeCount,
+		dataOffset: 4 + metaLength,
 
-		meta:    meta,
-		refType: dm,
+		meta:       meta,
+		fieldIndex: make(map[string]int, len(meta.Fields)),
 
 		data: body[4+metaLength:],
 	}
+	db.refs.Store(1)
+	if obj != nil {
+		db.planFor(reflect.TypeOf(obj).Elem())
+	}
+	for i, f := range meta.Fields {
+		db.fieldIndex[f] = i
+	}
+	width := len(meta.Fields)
+	db.bufs.New = func() interface{} {
+		buf := make([]string, 0, width)
+		return &buf
+	}
 
 	if db.v4offset == 0 {
 		node := 0
@@ -139,81 +270,329 @@ func (db *reader) FindMap(addr, language string) (map[string]string, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	return db.toMap(data), nil
+}
+
+func (db *reader) findMapAddr(ip netip.Addr, language string) (map[string]string, error) {
+
+	data, err := db.find1Addr(ip, language)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.toMap(data), nil
+}
+
+func (db *reader) toMap(data []string) map[string]string {
 	info := make(map[string]string, len(db.meta.Fields))
 	for k, v := range data {
 		info[db.meta.Fields[k]] = v
 	}
 
-	return info, nil
+	return info
+}
+
+func parseAddr(addr string) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || ip.Zone() != "" {
+		return netip.Addr{}, ErrIPFormat
+	}
+
+	return ip, nil
 }
 
 func (db *reader) find0(addr string) ([]byte, error) {
 
-	var err error
-	var node int
-	ipv := net.ParseIP(addr)
-	if ip := ipv.To4(); ip != nil {
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	_, body, err := db.findAddr(ip)
+	return body, err
+}
+
+// findAddr returns the leaf of ip and its record
+func (db *reader) findAddr(ip netip.Addr) (int, []byte, error) {
+	leaf, body, _, err := db.lookup(ip)
+	return leaf, body, err
+}
+
+// lookup returns the leaf of ip, its record and the network it applies to
+func (db *reader) lookup(ip netip.Addr) (_ int, _ []byte, _ netip.Prefix, err error) {
+
+	if db.data == nil {
+		return -1, nil, netip.Prefix{}, ErrDatabaseClosed
+	}
+	if db.unmap != nil {
+		defer db.recoverFault(debug.SetPanicOnFault(true), &err)
+	}
+	is4 := ip.Is4() || ip.Is4In6()
+	// the jump table finds IPv4 addresses as fast as the cache
+	cached := db.cache != nil && !(is4 && db.jump != nil)
+	if cached {
+		if leaf, body, prefix, ok := db.cache.get(ip.Unmap()); ok {
+			return leaf, body, prefix, nil
+		}
+	}
+
+	var node, bits int
+	if is4 {
 		if !db.IsIPv4Support() {
-			return nil, ErrNoSupportIPv4
+			return -1, nil, netip.Prefix{}, ErrNoSupportIPv4
 		}
 
-		node, err = db.search(ip, 32)
-	} else if ip := ipv.To16(); ip != nil {
+		ip = ip.Unmap()
+		b := ip.As4()
+		node, bits, err = db.search(b[:], 32)
+	} else if ip.Is6() {
 		if !db.IsIPv6Support() {
-			return nil, ErrNoSupportIPv6
+			return -1, nil, netip.Prefix{}, ErrNoSupportIPv6
 		}
 
-		node, err = db.search(ip, 128)
+		b := ip.As16()
+		node, bits, err = db.search(b[:], 128)
 	} else {
-		return nil, ErrIPFormat
+		return -1, nil, netip.Prefix{}, ErrIPFormat
 	}
 
 	if err != nil || node < 0 {
-		return nil, err
+		return -1, nil, netip.Prefix{}, err
 	}
 
 	body, err := db.resolve(node)
 	if err != nil {
-		return nil, err
+		return -1, nil, netip.Prefix{}, err
+	}
+	prefix := netip.PrefixFrom(ip, bits)
+	if cached {
+		db.cache.add(ip, node, body, prefix)
 	}
 
-	return body, nil
+	return node, body, prefix, nil
 }
 
 func (db *reader) find1(addr, language string) ([]string, error) {
 
+	ip, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.find1Addr(ip, language)
+}
+
+func (db *reader) find1Addr(ip netip.Addr, language string) ([]string, error) {
+	return db.findInto(ip, language, make([]string, 0, len(db.meta.Fields)))
+}
+
+// findInto appends the fields of language to dst[:0]
+func (db *reader) findInto(ip netip.Addr, language string, dst []string) ([]string, error) {
+
 	off, ok := db.meta.Languages[language]
 	if !ok {
 		return nil, ErrNoSupportLanguage
 	}
 
-	body, err := db.find0(addr)
+	leaf, body, err := db.findAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.fieldsInto(leaf, body, off, dst)
+}
+
+// findLangs returns the fields of ip, each taken from the first of
+// languages that has a non-empty value for it. Languages the database
+// does not support are skipped.
+func (db *reader) findLangs(ip netip.Addr, languages []string) ([]string, error) {
+
+	leaf, body, err := db.findAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []string
+	buf := db.fieldBuf()
+	defer db.putFieldBuf(buf)
+	for _, language := range languages {
+		off, ok := db.meta.Languages[language]
+		if !ok {
+			continue
+		}
+		if data == nil {
+			data, err = db.fieldsInto(leaf, body, off, make([]string, 0, len(db.meta.Fields)))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		more, err := db.fieldsInto(leaf, body, off, (*buf)[:0])
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range data {
+			if v == "" {
+				data[k] = more[k]
+			}
+		}
+	}
+	if data == nil {
+		return nil, ErrNoSupportLanguage
+	}
+
+	return data, nil
+}
+
+// findAllLanguages returns the fields of ip for every language
+func (db *reader) findAllLanguages(ip netip.Addr) (map[string][]string, error) {
+
+	leaf, body, err := db.findAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string][]string, len(db.meta.Languages))
+	for language, off := range db.meta.Languages {
+		data, err := db.fieldsInto(leaf, body, off, make([]string, 0, len(db.meta.Fields)))
+		if err != nil {
+			return nil, err
+		}
+		all[language] = data
+	}
+
+	return all, nil
+}
+
+// fieldsInto appends the fields at language offset off of body, the
+// record of leaf, to dst[:0]
+func (db *reader) fieldsInto(leaf int, body []byte, off int, dst []string) (_ []string, err error) {
+
+	if db.unmap != nil {
+		defer db.recoverFault(debug.SetPanicOnFault(true), &err)
+	}
+	dst = dst[:0]
+	str := db.recordString(body)
+	for i := 0; i < off; i++ {
+		n := strings.IndexByte(str, '\t')
+		if n < 0 {
+			return nil, formatError(ErrDatabaseError, db.recordOffset(leaf), leaf, "record has no fields for the language")
+		}
+		str = str[n+1:]
+	}
+	for i := len(db.meta.Fields); i > 0; i-- {
+		n := strings.IndexByte(str, '\t')
+		if n < 0 {
+			if i > 1 {
+				return nil, formatError(ErrDatabaseError, db.recordOffset(leaf), leaf, "record has too few fields")
+			}
+			n = len(str)
+		}
+		dst = append(dst, str[:n])
+		if n < len(str) {
+			str = str[n+1:]
+		}
+	}
+
+	return dst, nil
+}
+
+func (db *reader) findWithNetwork(ip netip.Addr, language string) (LookupResult, error) {
+
+	off, ok := db.meta.Languages[language]
+	if !ok {
+		return LookupResult{}, ErrNoSupportLanguage
+	}
+
+	leaf, body, prefix, err := db.lookup(ip)
+	if err != nil {
+		return LookupResult{}, err
+	}
+
+	data, err := db.fieldsInto(leaf, body, off, make([]string, 0, len(db.meta.Fields)))
+	if err != nil {
+		return LookupResult{}, err
+	}
+
+	return LookupResult{Prefix: prefix.Masked(), Record: data}, nil
+}
+
+// findFieldsInto sets dst[i] to the value of fields[i] in language
+func (db *reader) findFieldsInto(ip netip.Addr, language string, dst []string, fields []string) ([]string, error) {
+
+	for _, f := range fields {
+		if _, ok := db.fieldIndex[f]; !ok {
+			return nil, ErrNoSupportField
+		}
+	}
+
+	buf := db.fieldBuf()
+	defer db.putFieldBuf(buf)
+	data, err := db.findInto(ip, language, (*buf)[:0])
 	if err != nil {
 		return nil, err
 	}
 
-	str := (*string)(unsafe.Pointer(&body))
-	tmp := strings.Split(*str, "\t")
+	dst = dst[:0]
+	for _, f := range fields {
+		dst = append(dst, data[db.fieldIndex[f]])
+	}
+
+	return dst, nil
+}
 
-	if (off + len(db.meta.Fields)) > len(tmp) {
-		return nil, ErrDatabaseError
+// recordString returns body as a string without copying it, unless the
+// database is mapped and the mapping may go away once the lookup returns
+func (db *reader) recordString(body []byte) string {
+	if db.unmap != nil {
+		return string(body)
 	}
+	return *(*string)(unsafe.Pointer(&body))
+}
+
+// recoverFault restores the fault handling of the goroutine to old and
+// turns a fault on the mapped file, which happens once the file is
+// truncated under the mapping, into an error instead of a crash
+func (db *reader) recoverFault(old bool, err *error) {
+	debug.SetPanicOnFault(old)
 
-	return tmp[off : off+len(db.meta.Fields)], nil
+	e := recover()
+	if e == nil {
+		return
+	}
+	fault, ok := e.(interface{ Addr() uintptr })
+	if !ok {
+		panic(e)
+	}
+	offset := -1
+	if len(db.data) > 0 {
+		base := uintptr(unsafe.Pointer(&db.data[0]))
+		if addr := fault.Addr(); addr >= base && addr < base+uintptr(len(db.data)) {
+			offset = db.dataOffset + int(addr-base)
+		}
+	}
+	*err = formatError(ErrDatabaseError, offset, -1, "mapped file was truncated or rewritten in place")
 }
 
-func (db *reader) search(ip net.IP, bitCount int) (int, error) {
+// search walks the tree along ip and returns the leaf reached together
+// with the number of bits consumed to reach it
+func (db *reader) search(ip []byte, bitCount int) (int, int, error) {
 
-	var node int
+	var node, i int
 
 	if bitCount == 32 {
 		node = db.v4offset
+		if db.jump != nil {
+			node, i = db.jump.start(ip)
+		}
 	} else {
 		node = 0
 	}
 
-	for i := 0; i < bitCount; i++ {
-		if node > db.nodeCount {
+	for ; i < bitCount; i++ {
+		// node_count itself marks an empty branch
+		if node >= db.nodeCount {
 			break
 		}
 
@@ -221,32 +600,106 @@ func (db *reader) search(ip net.IP, bitCount int) (int, error) {
 	}
 
 	if node > db.nodeCount {
-		return node, nil
+		return node, i, nil
 	}
 
-	return -1, ErrDataNotExists
+	return -1, 0, ErrDataNotExists
 }
 
+// readNode returns a child of node, which must be below nodeCount;
+// initBytes guarantees the node table is that large
 func (db *reader) readNode(node, index int) int {
 	off := node*8 + index*4
 	return int(binary.BigEndian.Uint32(db.data[off : off+4]))
 }
 
+// recordOffset returns the file offset of the record leaf points to
+func (db *reader) recordOffset(leaf int) int {
+	return db.dataOffset + leaf - db.nodeCount + db.nodeCount*8
+}
+
 func (db *reader) resolve(node int) ([]byte, error) {
 	resolved := node - db.nodeCount + db.nodeCount*8
-	if resolved >= db.fileSize {
-		return nil, ErrDatabaseError
+	if resolved < db.nodeCount*8 || resolved+2 > len(db.data) {
+		return nil, formatError(ErrDatabaseError, db.recordOffset(node), node, "record pointer beyond end of data")
 	}
 
 	size := int(binary.BigEndian.Uint16(db.data[resolved : resolved+2]))
 	if (resolved + 2 + size) > len(db.data) {
-		return nil, ErrDatabaseError
+		return nil, formatError(ErrDatabaseError, db.recordOffset(node), node, "record length "+strconv.Itoa(size)+" beyond end of data")
 	}
 	bytes := db.data[resolved+2 : resolved+2+size]
 
 	return bytes, nil
 }
 
+// validate checks every node of the search tree and every record it
+// points to, so that no lookup on the database can fail with
+// ErrDatabaseError
+func (db *reader) validate() error {
+	width := 0
+	for _, off := range db.meta.Languages {
+		if off+len(db.meta.Fields) > width {
+			width = off + len(db.meta.Fields)
+		}
+	}
+
+	for i := 0; i < db.nodeCount*2; i++ {
+		node := db.readNode(i>>1, i&1)
+		if node <= db.nodeCount {
+			continue
+		}
+		body, err := db.resolve(node)
+		if err != nil {
+			return err
+		}
+		if bytes.Count(body, []byte{'\t'})+1 < width {
+			return formatError(ErrDatabaseError, db.recordOffset(node), node, "record has too few fields")
+		}
+	}
+
+	return nil
+}
+
+// fieldBuf returns a scratch slice for the fields of one record, to be
+// given back with putFieldBuf once the values were copied out
+func (db *reader) fieldBuf() *[]string {
+	return db.bufs.Get().(*[]string)
+}
+
+func (db *reader) putFieldBuf(buf *[]string) {
+	db.bufs.Put(buf)
+}
+
+func (db *reader) retain() bool {
+	for {
+		n := db.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if db.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (db *reader) release() {
+	if db.refs.Add(-1) == 0 {
+		db.close()
+	}
+}
+
+// close releases the database content, unmapping it if it was mapped
+func (db *reader) close() error {
+	db.data = nil
+	if db.unmap == nil {
+		return nil
+	}
+	unmap := db.unmap
+	db.unmap = nil
+	return unmap()
+}
+
 func (db *reader) IsIPv4Support() bool {
 	return (int(db.meta.IPVersion) & IPv4) == IPv4
 }
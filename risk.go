@@ -1,42 +1,95 @@
 package ipdb
 
-import "strconv"
+import (
+	"io"
+	"io/fs"
+	"net/netip"
+)
 
 type RiskInfo struct {
-	Score       int
-	Behavior    string
-	CountryCode string
+	Score       int    `ipdb:"score"`
+	Behavior    string `ipdb:"behavior"`
+	CountryCode string `ipdb:"country_code"`
 }
 
 type Risk struct {
-	reader *reader
+	database
 }
 
 func NewRisk(fn string) (*Risk, error) {
-	r, e := newReader(fn, &RiskInfo{})
-	if e != nil {
+	return OpenRisk(fn)
+}
+
+func OpenRisk(fn string, opts ...Option) (*Risk, error) {
+	r := &Risk{}
+	if e := r.open(fn, &RiskInfo{}, opts); e != nil {
+		return nil, e
+	}
+	return r, nil
+}
+
+func NewRiskFromBytes(bs []byte) (*Risk, error) {
+	r := &Risk{}
+	if e := r.openBytes(bs, &RiskInfo{}); e != nil {
 		return nil, e
 	}
-	return &Risk{reader: r}, nil
+	return r, nil
+}
+
+// OpenRiskFS initialize with the file name of fsys, such as an embed.FS
+func OpenRiskFS(fsys fs.FS, name string, opts ...Option) (*Risk, error) {
+	r := &Risk{}
+	if e := r.openFS(fsys, name, &RiskInfo{}, opts); e != nil {
+		return nil, e
+	}
+	return r, nil
+}
+
+// OpenRiskReader initialize with the file read from src, size bytes or
+// all of src if size is negative
+func OpenRiskReader(src io.Reader, size int64, opts ...Option) (*Risk, error) {
+	r := &Risk{}
+	if e := r.openReader(src, size, &RiskInfo{}, opts); e != nil {
+		return nil, e
+	}
+	return r, nil
+}
+
+// Snapshot returns a Risk pinned to the currently loaded build, so that
+// several lookups see the same data even if Reload runs in between.
+// The snapshot can not be reloaded; Close it when done.
+func (r *Risk) Snapshot() (*Risk, error) {
+	s := &Risk{}
+	if e := r.pin(&s.database); e != nil {
+		return nil, e
+	}
+	return s, nil
 }
 
 func (r *Risk) FindInfo(addr string) (*RiskInfo, error) {
+	ip, e := parseAddr(addr)
+	if e != nil {
+		return &RiskInfo{}, e
+	}
+	return r.FindInfoAddr(ip)
+}
+
+func (r *Risk) FindInfoAddr(addr netip.Addr) (*RiskInfo, error) {
 	info := &RiskInfo{}
 
-	m, e := r.reader.FindMap(addr, "CN")
+	db, e := r.acquire()
 	if e != nil {
 		return info, e
 	}
+	defer db.release()
 
-	if v, ok := m["score"]; ok {
-		info.Score, _ = strconv.Atoi(v)
-	}
-	if v, ok := m["behavior"]; ok {
-		info.Behavior = v
-	}
-	if v, ok := m["country_code"]; ok {
-		info.CountryCode = v
+	buf := db.fieldBuf()
+	defer db.putFieldBuf(buf)
+	data, e := db.findInto(addr, "CN", (*buf)[:0])
+	if e != nil {
+		return info, e
 	}
 
+	info, _ = decodeInfo[RiskInfo](db, data)
 	return info, nil
 }
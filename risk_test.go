@@ -1,6 +1,10 @@
 package ipdb
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
 
 func TestNewRisk(t *testing.T) {
 	r, e := NewRisk("c:/work/ipdb/v6risk.ipdb")
@@ -17,3 +21,28 @@ func TestNewRisk(t *testing.T) {
 		t.Log(e)
 	}
 }
+
+func TestRisk_FindInfo(t *testing.T) {
+	body := singleRecordDB(t, []string{"score", "behavior", "country_code"}, map[string]int{"CN": 0}, "85\tproxy\tCN")
+	r, err := OpenRiskReader(bytes.NewReader(body), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := r.FindInfo("1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *info != (RiskInfo{Score: 85, Behavior: "proxy", CountryCode: "CN"}) {
+		t.Fatalf("FindInfo = %+v", info)
+	}
+
+	// the JSON encoding keeps the Go field names
+	b, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"Score":85,"Behavior":"proxy","CountryCode":"CN"}` {
+		t.Fatalf("json = %s", b)
+	}
+}
@@ -0,0 +1,177 @@
+package ipdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// isCompressed whether body is a gzip or zstd frame. An ipdb file starts
+// with the length of its metadata, which is far too short to look like
+// either.
+func isCompressed(body []byte) bool {
+	return bytes.HasPrefix(body, gzipMagic) || bytes.HasPrefix(body, zstdMagic)
+}
+
+// decompress returns body, decompressed if it is gzip or zstd framed
+func decompress(body []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(body, gzipMagic):
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+
+	case bytes.HasPrefix(body, zstdMagic):
+		zr, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return zr.DecodeAll(body, nil)
+	}
+
+	return body, nil
+}
+
+// readAll reads size bytes from r, or all of r if size is negative
+func readAll(r io.Reader, size int64) ([]byte, error) {
+	if size < 0 {
+		return io.ReadAll(r)
+	}
+	if size < 4 {
+		return nil, formatError(ErrFileSize, int(size), -1, "file too short for the metadata length")
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, ErrReadFull
+	}
+
+	return body, nil
+}
+
+func newReaderFromFS(fsys fs.FS, name string, obj interface{}, opts options) (*reader, error) {
+	body, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReaderFromBytes(body, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.load(r, obj)
+}
+
+func newReaderFromReader(src io.Reader, size int64, obj interface{}, opts options) (*reader, error) {
+	body, err := readAll(src, size)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReaderFromBytes(body, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.load(r, obj)
+}
+
+func (db *database) openFS(fsys fs.FS, name string, obj interface{}, opts []Option) error {
+	db.obj = obj
+	db.opts = newOptions(opts)
+
+	r, err := newReaderFromFS(fsys, name, obj, db.opts)
+	if err != nil {
+		return err
+	}
+	db.cur.Store(r)
+
+	return nil
+}
+
+func (db *database) openReader(src io.Reader, size int64, obj interface{}, opts []Option) error {
+	db.obj = obj
+	db.opts = newOptions(opts)
+
+	r, err := newReaderFromReader(src, size, obj, db.opts)
+	if err != nil {
+		return err
+	}
+	db.cur.Store(r)
+
+	return nil
+}
+
+// ReloadFS is Reload with the file name of fsys
+func (db *database) ReloadFS(fsys fs.FS, name string) error {
+	if db.snapshot {
+		return ErrSnapshotReload
+	}
+
+	r, err := newReaderFromFS(fsys, name, db.obj, db.opts)
+	if err != nil {
+		return err
+	}
+
+	return db.replace(r)
+}
+
+// ReloadReader is Reload with a file read from src, size bytes or all
+// of src if size is negative
+func (db *database) ReloadReader(src io.Reader, size int64) error {
+	if db.snapshot {
+		return ErrSnapshotReload
+	}
+
+	r, err := newReaderFromReader(src, size, db.obj, db.opts)
+	if err != nil {
+		return err
+	}
+
+	return db.replace(r)
+}
+
+// replace validates r and installs it as the current reader
+func (db *database) replace(r *reader) error {
+	if !r.validated {
+		if err := r.validate(); err != nil {
+			r.close()
+			return err
+		}
+	}
+	return db.swap(r)
+}
+
+// OpenFS is Open for the file name of fsys, such as an embed.FS
+func OpenFS(fsys fs.FS, name string, opts ...Option) (Database, error) {
+	o := newOptions(opts)
+	r, err := newReaderFromFS(fsys, name, nil, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDatabase(r, o), nil
+}
+
+// OpenReader is Open for a file read from src, size bytes or all of src
+// if size is negative
+func OpenReader(src io.Reader, size int64, opts ...Option) (Database, error) {
+	o := newOptions(opts)
+	r, err := newReaderFromReader(src, size, nil, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDatabase(r, o), nil
+}
@@ -0,0 +1,171 @@
+package ipdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressedFiles(t *testing.T) (plain, gz, zst []byte) {
+	plain, err := os.ReadFile("city.free.ipdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(plain)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz = buf.Bytes()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst = enc.EncodeAll(plain, nil)
+	enc.Close()
+
+	return plain, gz, zst
+}
+
+func TestOpenCityFS(t *testing.T) {
+	plain, gz, zst := compressedFiles(t)
+	fsys := fstest.MapFS{
+		"data/city.ipdb":      {Data: plain},
+		"data/city.ipdb.gz":   {Data: gz},
+		"data/city.ipdb.zst":  {Data: zst},
+		"data/broken.ipdb.gz": {Data: gz[:len(gz)/2]},
+	}
+
+	for _, name := range []string{"data/city.ipdb", "data/city.ipdb.gz", "data/city.ipdb.zst"} {
+		cdb, err := OpenCityFS(fsys, name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		info, err := cdb.FindInfo("118.28.1.1", "CN")
+		if err != nil || info.CityName != "天津" {
+			t.Errorf("%s: FindInfo = %+v, %v", name, info, err)
+		}
+		if cdb.BuildTime().Unix() != 1535696240 {
+			t.Errorf("%s: BuildTime = %v", name, cdb.BuildTime())
+		}
+	}
+
+	if _, err := OpenCityFS(fsys, "data/broken.ipdb.gz"); !errors.Is(err, ErrDatabaseError) {
+		t.Fatalf("OpenCityFS(truncated gzip) = %v", err)
+	}
+	if _, err := OpenCityFS(fsys, "data/missing.ipdb"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenCityFS(missing) = %v", err)
+	}
+
+	// Open detects the type as usual
+	got, err := OpenFS(fsys, "data/city.ipdb.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.(*City); !ok {
+		t.Fatalf("OpenFS = %T", got)
+	}
+
+	cdb, err := NewCityFromBytes(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cdb.Fields()) != 3 {
+		t.Fatalf("NewCityFromBytes(gzip) fields = %v", cdb.Fields())
+	}
+}
+
+func TestOpenCityReader(t *testing.T) {
+	plain, gz, _ := compressedFiles(t)
+
+	for _, c := range []struct {
+		body []byte
+		size int64
+	}{
+		{plain, int64(len(plain))},
+		{plain, -1},
+		{gz, int64(len(gz))},
+		{gz, -1},
+	} {
+		cdb, err := OpenCityReader(bytes.NewReader(c.body), c.size)
+		if err != nil {
+			t.Fatal(c.size, err)
+		}
+		if res, err := cdb.FindMap("118.28.1.1", "CN"); err != nil || res["city_name"] != "天津" {
+			t.Errorf("FindMap = %v, %v", res, err)
+		}
+	}
+
+	if _, err := OpenCityReader(bytes.NewReader(plain[:1000]), int64(len(plain))); !errors.Is(err, ErrReadFull) {
+		t.Fatalf("OpenCityReader(short) = %v", err)
+	}
+	if _, err := OpenRiskReader(bytes.NewReader(plain), 2); !errors.Is(err, ErrFileSize) {
+		t.Fatalf("OpenRiskReader(size 2) = %v", err)
+	}
+}
+
+func TestReloadFS(t *testing.T) {
+	plain, gz, zst := compressedFiles(t)
+	other := buildBytes(t, []string{"country_name", "region_name", "city_name"}, testNetworks{"0.0.0.0/0": {"CN": {"甲", "乙", "丙"}}})
+
+	cdb, err := OpenCityReader(bytes.NewReader(other), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{"city.ipdb.gz": {Data: gz}}
+	if err := cdb.ReloadFS(fsys, "city.ipdb.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := cdb.FindMap("118.28.1.1", "CN"); res["city_name"] != "天津" {
+		t.Fatalf("after ReloadFS = %v", res)
+	}
+
+	// a broken file leaves the loaded one in use
+	if err := cdb.ReloadReader(bytes.NewReader(zst[:100]), -1); err == nil {
+		t.Fatal("ReloadReader(truncated zstd) succeeded")
+	}
+	if err := cdb.ReloadReader(bytes.NewReader(other), int64(len(other))); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := cdb.FindMap("118.28.1.1", "CN"); res["city_name"] != "丙" {
+		t.Fatalf("after ReloadReader = %v", res)
+	}
+
+	snap, err := cdb.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if err := snap.ReloadReader(bytes.NewReader(plain), -1); !errors.Is(err, ErrSnapshotReload) {
+		t.Fatalf("Snapshot ReloadReader = %v", err)
+	}
+}
+
+func TestOpenCityMmap_Compressed(t *testing.T) {
+	_, gz, _ := compressedFiles(t)
+	name := filepath.Join(t.TempDir(), "city.ipdb.gz")
+	writeFile(t, name, gz)
+
+	for _, opts := range [][]Option{nil, {WithMmap()}} {
+		cdb, err := OpenCity(name, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := cdb.FindMap("118.28.1.1", "CN"); err != nil || res["city_name"] != "天津" {
+			t.Errorf("FindMap = %v, %v", res, err)
+		}
+		if err := cdb.Reload(name); err != nil {
+			t.Fatal(err)
+		}
+		cdb.Close()
+	}
+}
@@ -0,0 +1,174 @@
+package ipdb
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// SubsetOptions selects what Subset keeps of a database
+type SubsetOptions struct {
+	// Languages to keep, all if empty
+	Languages []string
+	// Fields to keep, in this order, all if empty
+	Fields []string
+
+	// Countries restricts the records to those whose CountryField is
+	// one of these values in any language, the other networks get
+	// Placeholder. No restriction if empty.
+	Countries []string
+	// CountryField defaults to country_code, or country_name if the
+	// database has no country_code
+	CountryField string
+	// Placeholder holds the values of the kept fields for every kept
+	// language, all fields are empty if nil
+	Placeholder map[string][]string
+}
+
+// Subset returns a Builder holding the networks of the database with
+// only the selected languages and fields, and optionally only the
+// records of some countries. Networks whose records become identical
+// are merged again when the builder is written.
+func (db *database) Subset(opts SubsetOptions) (*Builder, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.subset(opts)
+}
+
+func (db *reader) subset(opts SubsetOptions) (*Builder, error) {
+	languages := opts.Languages
+	if len(languages) == 0 {
+		// in the order of the source records
+		languages = db.Languages()
+		sort.Slice(languages, func(i, j int) bool {
+			return db.meta.Languages[languages[i]] < db.meta.Languages[languages[j]]
+		})
+	}
+	for _, language := range languages {
+		if _, ok := db.meta.Languages[language]; !ok {
+			return nil, ErrNoSupportLanguage
+		}
+	}
+
+	fields := opts.Fields
+	if len(fields) == 0 {
+		fields = db.meta.Fields
+	}
+	index := make([]int, len(fields))
+	for i, f := range fields {
+		n, ok := db.fieldIndex[f]
+		if !ok {
+			return nil, ErrNoSupportField
+		}
+		index[i] = n
+	}
+
+	country := -1
+	countries := make(map[string]bool, len(opts.Countries))
+	if len(opts.Countries) > 0 {
+		name := opts.CountryField
+		if name == "" {
+			name = "country_code"
+			if _, ok := db.fieldIndex[name]; !ok {
+				name = "country_name"
+			}
+		}
+		n, ok := db.fieldIndex[name]
+		if !ok {
+			return nil, ErrNoSupportField
+		}
+		country = n
+		for _, c := range opts.Countries {
+			countries[c] = true
+		}
+	}
+
+	b, err := NewBuilder(fields, languages...)
+	if err != nil {
+		return nil, err
+	}
+	b.SetBuild(db.Build())
+
+	placeholder := opts.Placeholder
+	if placeholder == nil {
+		placeholder = make(map[string][]string, len(languages))
+		for _, language := range languages {
+			placeholder[language] = make([]string, len(fields))
+		}
+	}
+	// check the placeholder before walking
+	if _, err := b.record(placeholder); err != nil {
+		return nil, err
+	}
+
+	values := make(map[int]map[string][]string) // leaf -> values
+	buf := make([]string, 0, len(db.meta.Fields))
+	insert := func(leaf int, prefix netip.Prefix) error {
+		v, ok := values[leaf]
+		if !ok {
+			body, err := db.resolve(leaf)
+			if err != nil {
+				return err
+			}
+
+			keep := country < 0
+			for _, off := range db.meta.Languages {
+				if keep {
+					break
+				}
+				if buf, err = db.fieldsInto(leaf, body, off, buf); err != nil {
+					return err
+				}
+				keep = countries[buf[country]]
+			}
+
+			v = placeholder
+			if keep {
+				v = make(map[string][]string, len(languages))
+				for _, language := range languages {
+					if buf, err = db.fieldsInto(leaf, body, db.meta.Languages[language], buf); err != nil {
+						return err
+					}
+					data := make([]string, len(index))
+					for i, n := range index {
+						data[i] = buf[n]
+					}
+					v[language] = data
+				}
+			}
+			values[leaf] = v
+		}
+
+		return b.Insert(prefix, v)
+	}
+
+	if db.IsIPv4Support() && db.v4offset != db.nodeCount {
+		w := db.walkLeaves(db.v4offset, netip.IPv4Unspecified().As16(), 96)
+		for leaf, prefix, ok := w.next(); ok; leaf, prefix, ok = w.next() {
+			if err := insert(leaf, prefix); err != nil {
+				return nil, err
+			}
+		}
+		if w.err != nil {
+			return nil, w.err
+		}
+	}
+	if db.IsIPv6Support() {
+		// IPv4 was walked from its root
+		w := db.walkLeaves(0, [16]byte{}, 0)
+		w.skip4 = true
+		for leaf, prefix, ok := w.next(); ok; leaf, prefix, ok = w.next() {
+			if err := insert(leaf, prefix); err != nil {
+				return nil, err
+			}
+		}
+		if w.err != nil {
+			return nil, w.err
+		}
+	}
+
+	return b, nil
+}
@@ -0,0 +1,76 @@
+package ipdb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCity_Subset(t *testing.T) {
+	b, err := db.Subset(SubsetOptions{
+		Fields:    []string{"country_name", "city_name"},
+		Countries: []string{"中国"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sub.Fields()) != 2 || sub.BuildTime() != db.BuildTime() {
+		t.Fatalf("Fields = %v, BuildTime = %v", sub.Fields(), sub.BuildTime())
+	}
+	if n, orig := sub.current().nodeCount, db.current().nodeCount; n >= orig {
+		t.Fatalf("node_count %d, original %d", n, orig)
+	}
+
+	for _, addr := range []string{"1.1.1.1", "8.8.8.8", "114.114.114.114", "223.5.5.5", "118.28.1.1"} {
+		want, err := db.FindMap(addr, "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := sub.FindMap(addr, "CN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want["country_name"] != "中国" {
+			want = map[string]string{"country_name": "", "city_name": ""}
+		}
+		if got["country_name"] != want["country_name"] || got["city_name"] != want["city_name"] {
+			t.Errorf("%s: %v, original %v", addr, got, want)
+		}
+	}
+
+	report, err := sub.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("Verify = %+v", report)
+	}
+}
+
+func TestCity_SubsetErrors(t *testing.T) {
+	if _, err := db.Subset(SubsetOptions{Languages: []string{"EN"}}); !errors.Is(err, ErrNoSupportLanguage) {
+		t.Fatalf("Subset EN = %v", err)
+	}
+	if _, err := db.Subset(SubsetOptions{Fields: []string{"idc"}}); !errors.Is(err, ErrNoSupportField) {
+		t.Fatalf("Subset idc = %v", err)
+	}
+	if _, err := db.Subset(SubsetOptions{Countries: []string{"CN"}, CountryField: "country_code"}); !errors.Is(err, ErrNoSupportField) {
+		t.Fatalf("Subset country_code = %v", err)
+	}
+
+	cdb, err := NewCityFromBytes(selfLoopDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fe *FormatError
+	if _, err := cdb.Subset(SubsetOptions{}); !errors.Is(err, ErrDatabaseError) || !errors.As(err, &fe) || fe.Node != 0 {
+		t.Fatalf("Subset of a cyclic tree = %v", err)
+	}
+}
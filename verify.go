@@ -0,0 +1,242 @@
+package ipdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+)
+
+// IssueKind classifies a problem found by Verify
+type IssueKind string
+
+const (
+	// IssueCycle is a node pointing back to one of its ancestors
+	IssueCycle IssueKind = "cycle"
+	// IssueTooDeep is a node still inside the tree after 128 bits
+	IssueTooDeep IssueKind = "too_deep"
+	// IssuePointer is a pointer beyond node_count and total_size
+	IssuePointer IssueKind = "pointer"
+	// IssueRecordOverrun is a record whose length runs past the data
+	IssueRecordOverrun IssueKind = "record_overrun"
+	// IssueFieldCount is a record whose number of tab separated values
+	// is not len(fields) * len(languages)
+	IssueFieldCount IssueKind = "field_count"
+	// IssueUncoveredIPv4 is IPv4 space that has no record
+	IssueUncoveredIPv4 IssueKind = "uncovered_ipv4"
+)
+
+// maxVerifyIssues bounds VerifyReport.Issues, IssueCount keeps counting
+const maxVerifyIssues = 1000
+
+// VerifyIssue is one problem found by Verify
+type VerifyIssue struct {
+	Kind IssueKind `json:"kind"`
+	// Node holding the bad pointer, -1 if none
+	Node int `json:"node"`
+	// Offset in the file of the bad data, -1 if none
+	Offset int `json:"offset"`
+	// Prefix of the first path that reached the problem
+	Prefix netip.Prefix `json:"prefix"`
+	Detail string       `json:"detail"`
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	NodeCount int `json:"node_count"`
+	// ReachableNodes is the number of nodes reached from the roots,
+	// the others are never used by lookups
+	ReachableNodes int `json:"reachable_nodes"`
+	EmptyBranches  int `json:"empty_branches"`
+	Records        int `json:"records"`
+
+	// UncoveredIPv4Addresses is the number of IPv4 addresses without a
+	// record, each uncovered prefix is also reported as an issue
+	UncoveredIPv4Addresses uint64 `json:"uncovered_ipv4_addresses"`
+
+	// Issues holds the first problems found, IssueCount counts all
+	Issues     []VerifyIssue `json:"issues"`
+	IssueCount int           `json:"issue_count"`
+}
+
+// OK whether no issue was found
+func (r *VerifyReport) OK() bool {
+	return r.IssueCount == 0
+}
+
+func (r *VerifyReport) add(issue VerifyIssue) {
+	r.IssueCount++
+	if len(r.Issues) < maxVerifyIssues {
+		r.Issues = append(r.Issues, issue)
+	}
+}
+
+// Verify walks the whole search tree from the IPv6 root and from the
+// IPv4 root and checks every node and record it reaches: cycles,
+// pointers beyond the node table and the data, records overrunning the
+// data or with the wrong number of fields, and IPv4 space without a
+// record. Problems are collected in the report, the error is only set
+// if the database could not be walked at all.
+func (db *database) Verify() (*VerifyReport, error) {
+	r, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+
+	return r.verify(), nil
+}
+
+type verifyFrame struct {
+	node  int
+	child int
+	bits  int
+	ip    [16]byte
+}
+
+func (db *reader) verify() *VerifyReport {
+	report := &VerifyReport{NodeCount: db.nodeCount}
+
+	const (
+		white = iota
+		grey
+		black
+	)
+	color := make([]uint8, db.nodeCount)
+	records := make(map[int]bool)
+	width := len(db.meta.Fields) * len(db.meta.Languages)
+	cycles := false
+
+	stack := []verifyFrame{{node: 0}}
+	color[0] = grey
+	report.ReachableNodes++
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.child == 2 {
+			color[top.node] = black
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		bit := top.child
+		top.child++
+
+		next := db.readNode(top.node, bit)
+		ip := top.ip
+		if bit == 1 {
+			ip[top.bits>>3] |= 0x80 >> uint(top.bits&7)
+		}
+		bits := top.bits + 1
+		prefix := treePrefix(ip, bits)
+		offset := db.dataOffset + top.node*8 + bit*4
+
+		switch {
+		case next < db.nodeCount:
+			if bits >= 128 {
+				report.add(VerifyIssue{Kind: IssueTooDeep, Node: top.node, Offset: offset, Prefix: prefix,
+					Detail: "node " + strconv.Itoa(next) + " at depth 128"})
+				continue
+			}
+			switch color[next] {
+			case grey:
+				cycles = true
+				report.add(VerifyIssue{Kind: IssueCycle, Node: top.node, Offset: offset, Prefix: prefix,
+					Detail: "points back to node " + strconv.Itoa(next)})
+			case white:
+				color[next] = grey
+				report.ReachableNodes++
+				stack = append(stack, verifyFrame{node: next, bits: bits, ip: ip})
+			}
+		case next == db.nodeCount:
+			report.EmptyBranches++
+		default:
+			if records[next] {
+				continue
+			}
+			records[next] = true
+			db.verifyRecord(report, top.node, next, offset, prefix, width)
+		}
+	}
+	report.Records = len(records)
+
+	// the coverage of a tree with cycles is meaningless
+	if db.IsIPv4Support() && !cycles {
+		db.verifyIPv4(report)
+	}
+
+	return report
+}
+
+func (db *reader) verifyRecord(report *VerifyReport, node, next, offset int, prefix netip.Prefix, width int) {
+	resolved := next - db.nodeCount + db.nodeCount*8
+	if resolved+2 > len(db.data) {
+		report.add(VerifyIssue{Kind: IssuePointer, Node: node, Offset: offset, Prefix: prefix,
+			Detail: "pointer " + strconv.Itoa(next) + " beyond node_count and total_size"})
+		return
+	}
+
+	size := int(binary.BigEndian.Uint16(db.data[resolved : resolved+2]))
+	if resolved+2+size > len(db.data) {
+		report.add(VerifyIssue{Kind: IssueRecordOverrun, Node: node, Offset: db.dataOffset + resolved, Prefix: prefix,
+			Detail: "record length " + strconv.Itoa(size) + " beyond end of data"})
+		return
+	}
+
+	n := bytes.Count(db.data[resolved+2:resolved+2+size], []byte{'\t'}) + 1
+	if n != width {
+		report.add(VerifyIssue{Kind: IssueFieldCount, Node: node, Offset: db.dataOffset + resolved, Prefix: prefix,
+			Detail: strconv.Itoa(n) + " values, want " + strconv.Itoa(width)})
+	}
+}
+
+// verifyIPv4 reports the IPv4 prefixes a lookup finds no record for.
+// A subtree reached again at the same depth is counted from its first
+// walk and its prefixes are not reported again, so that the walk enters
+// every node at most once per depth.
+func (db *reader) verifyIPv4(report *VerifyReport) {
+	// uncovered addresses below the nodes already walked, at depth-1;
+	// other depths, which only a damaged tree has, go to the map
+	depth := make([]int8, db.nodeCount)
+	counts := make([]uint64, db.nodeCount)
+	type key struct{ node, bits int }
+	more := make(map[key]uint64)
+
+	var walk func(node int, ip uint32, bits int) uint64
+	walk = func(node int, ip uint32, bits int) uint64 {
+		switch {
+		case node > db.nodeCount:
+			// leaf, checked by verify
+			return 0
+		case node == db.nodeCount, bits == 32:
+			b := [4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}
+			report.add(VerifyIssue{Kind: IssueUncoveredIPv4, Node: -1, Offset: -1,
+				Prefix: netip.PrefixFrom(netip.AddrFrom4(b), bits)})
+			return 1 << uint(32-bits)
+		}
+
+		if int(depth[node]) == bits+1 {
+			return counts[node]
+		}
+		if n, ok := more[key{node, bits}]; ok {
+			return n
+		}
+		n := walk(db.readNode(node, 0), ip, bits+1) +
+			walk(db.readNode(node, 1), ip|1<<uint(31-bits), bits+1)
+		if depth[node] == 0 {
+			depth[node], counts[node] = int8(bits+1), n
+		} else {
+			more[key{node, bits}] = n
+		}
+		return n
+	}
+	report.UncoveredIPv4Addresses = walk(db.v4offset, 0, 0)
+}
+
+// treePrefix returns the prefix of the first bits of ip, a path from the
+// root of the tree; paths below ::ffff:0:0/96 are returned as IPv4
+func treePrefix(ip [16]byte, bits int) netip.Prefix {
+	addr := netip.AddrFrom16(ip)
+	if bits >= 96 && addr.Is4In6() {
+		return netip.PrefixFrom(addr.Unmap(), bits-96)
+	}
+	return netip.PrefixFrom(addr, bits)
+}
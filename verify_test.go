@@ -0,0 +1,154 @@
+package ipdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+	"testing"
+)
+
+func TestCity_Verify(t *testing.T) {
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("Verify city.free.ipdb: %+v", report.Issues)
+	}
+	if report.ReachableNodes == 0 || report.Records == 0 {
+		t.Fatalf("Verify walked nothing: %+v", report)
+	}
+	t.Logf("%d/%d nodes reachable, %d records", report.ReachableNodes, report.NodeCount, report.Records)
+}
+
+func TestVerify_Issues(t *testing.T) {
+	body := singleRecordDB(t, []string{"country_name", "city_name"}, map[string]int{"CN": 0}, "中国")
+	metaLength := int(binary.BigEndian.Uint32(body[0:4]))
+	nodes := body[4+metaLength:]
+
+	cdb, err := NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ := cdb.Verify()
+	if report.IssueCount != 1 || report.Issues[0].Kind != IssueFieldCount {
+		t.Fatalf("Verify = %+v, want one field count issue", report.Issues)
+	}
+
+	// the IPv4 root points to itself on the right and 0.0.0.0/1 is
+	// empty; the coverage of a cyclic tree is not reported
+	binary.BigEndian.PutUint32(nodes[96*8:], 97)
+	binary.BigEndian.PutUint32(nodes[96*8+4:], 96)
+	cdb, err = NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ = cdb.Verify()
+	if report.IssueCount != 1 || report.Issues[0].Kind != IssueCycle {
+		t.Fatalf("Verify = %+v, want one cycle", report.Issues)
+	}
+
+	// without the cycle 0.0.0.0/1 is reported
+	binary.BigEndian.PutUint32(nodes[96*8+4:], 97+16)
+	cdb, err = NewCityFromBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ = cdb.Verify()
+	kinds := map[IssueKind]int{}
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	if kinds[IssueUncoveredIPv4] != 1 || report.UncoveredIPv4Addresses != 1<<31 {
+		t.Fatalf("Verify = %+v", report)
+	}
+	for _, issue := range report.Issues {
+		if issue.Kind == IssueUncoveredIPv4 && issue.Prefix == netip.MustParsePrefix("0.0.0.0/1") {
+			return
+		}
+	}
+	t.Fatalf("0.0.0.0/1 not reported uncovered: %+v", report.Issues)
+}
+
+// selfLoopDB returns a database of a single node whose children both
+// point back to it, every walk of the tree that does not track the
+// nodes it entered runs forever
+func selfLoopDB(t testing.TB) []byte {
+	data := make([]byte, 8+16)
+	meta, err := json.Marshal(MetaData{
+		Build:     1000,
+		IPVersion: IPv4 | IPv6,
+		Languages: map[string]int{"CN": 0},
+		NodeCount: 1,
+		TotalSize: len(data),
+		Fields:    []string{"country_name", "region_name", "city_name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(meta)))
+	out = append(out, meta...)
+	return append(out, data...)
+}
+
+func TestVerify_SelfLoop(t *testing.T) {
+	cdb, err := NewCityFromBytes(selfLoopDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := cdb.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.IssueCount != 2 || report.Issues[0].Kind != IssueCycle || report.Issues[1].Kind != IssueCycle {
+		t.Fatalf("Verify = %+v, want two cycles", report.Issues)
+	}
+}
+
+func TestVerify_SharedSubtrees(t *testing.T) {
+	// both children of every IPv4 node below the root lead to the same
+	// next node, 2^32 paths over 32 nodes, the last one empty
+	body := singleRecordDB(t, []string{"country_name", "city_name"}, map[string]int{"CN": 0}, "中国\t北京")
+	metaLength := int(binary.BigEndian.Uint32(body[0:4]))
+	var meta MetaData
+	if err := json.Unmarshal(body[4:4+metaLength], &meta); err != nil {
+		t.Fatal(err)
+	}
+	nodeCount := 96 + 32
+	nodes := make([]byte, nodeCount*8)
+	copy(nodes, body[4+metaLength:4+metaLength+96*8])
+	for i := 0; i < 96; i++ {
+		for j := 0; j < 2; j++ {
+			if v := binary.BigEndian.Uint32(nodes[i*8+j*4:]); v == 97 {
+				binary.BigEndian.PutUint32(nodes[i*8+j*4:], uint32(nodeCount))
+			}
+		}
+	}
+	for i := 96; i < nodeCount; i++ {
+		next := uint32(i + 1)
+		binary.BigEndian.PutUint32(nodes[i*8:], next)
+		binary.BigEndian.PutUint32(nodes[i*8+4:], next)
+	}
+	data := append(nodes, make([]byte, 16)...)
+	meta.NodeCount = nodeCount
+	meta.TotalSize = len(data)
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(mb)))
+	out = append(append(out, mb...), data...)
+
+	cdb, err := NewCityFromBytes(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := cdb.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.UncoveredIPv4Addresses != 1<<32 {
+		t.Fatalf("UncoveredIPv4Addresses = %d", report.UncoveredIPv4Addresses)
+	}
+}
@@ -0,0 +1,113 @@
+package ipdb
+
+import (
+	"net/netip"
+	"strconv"
+)
+
+type walkFrame struct {
+	node int
+	bits int
+	ip   [16]byte
+}
+
+// leafWalker visits the leaves of the search tree below a node in
+// address order, skipping empty branches. It keeps its own stack so a
+// walk can be suspended between leaves.
+type leafWalker struct {
+	db    *reader
+	stack []walkFrame
+
+	// seen, if set, makes the walk enter every node once, so that a
+	// damaged tree with cycles or shared subtrees is still walked in
+	// linear time; leaves below a shared node are visited once
+	seen []bool
+
+	// skip4 skips the IPv4 subtree under ::ffff:0:0/96, for walks from
+	// the IPv6 root that visit IPv4 from its own root
+	skip4 bool
+
+	// empty also yields the empty leaves
+	empty bool
+
+	// path holds the nodes from the start of the walk down to the parent
+	// of the next frame, also marked in onPath; unless seen is set, a
+	// node met again on its own path is a cycle and ends the walk with
+	// err instead of walking it until the depth runs out
+	base   int
+	path   []int
+	onPath []bool
+	err    error
+}
+
+// walkLeaves starts a walk at node, reached by the first bits of ip
+func (db *reader) walkLeaves(node int, ip [16]byte, bits int) *leafWalker {
+	return &leafWalker{
+		db:    db,
+		stack: append(make([]walkFrame, 0, 64), walkFrame{node: node, bits: bits, ip: ip}),
+		base:  bits,
+	}
+}
+
+// next returns the next leaf pointer and the path to it, ok is false
+// once the walk is done or failed, see err
+func (w *leafWalker) next() (leaf int, prefix netip.Prefix, ok bool) {
+	db := w.db
+	for len(w.stack) > 0 && w.err == nil {
+		f := w.stack[len(w.stack)-1]
+		w.stack = w.stack[:len(w.stack)-1]
+
+		switch {
+		case w.skip4 && f.bits == 96 && netip.AddrFrom16(f.ip).Is4In6():
+			continue
+		case f.node > db.nodeCount:
+			return f.node, treePrefix(f.ip, f.bits), true
+		case f.node == db.nodeCount && w.empty:
+			return f.node, treePrefix(f.ip, f.bits), true
+		case f.node == db.nodeCount, f.bits >= 128:
+			continue
+		}
+		if w.seen != nil {
+			if w.seen[f.node] {
+				continue
+			}
+			w.seen[f.node] = true
+		} else if !w.enter(f) {
+			break
+		}
+
+		right := f.ip
+		right[f.bits>>3] |= 0x80 >> uint(f.bits&7)
+		// right first, so the left branch is visited first
+		w.stack = append(w.stack,
+			walkFrame{node: db.readNode(f.node, 1), bits: f.bits + 1, ip: right},
+			walkFrame{node: db.readNode(f.node, 0), bits: f.bits + 1, ip: f.ip})
+	}
+
+	return 0, netip.Prefix{}, false
+}
+
+// enter adds the node of f to the path, after leaving the nodes at its
+// depth and below. It sets err and returns false if the node is on the
+// path already.
+func (w *leafWalker) enter(f walkFrame) bool {
+	if w.onPath == nil {
+		w.onPath = make([]bool, w.db.nodeCount)
+	}
+	for len(w.path) > f.bits-w.base {
+		w.onPath[w.path[len(w.path)-1]] = false
+		w.path = w.path[:len(w.path)-1]
+	}
+
+	if w.onPath[f.node] {
+		parent := w.path[len(w.path)-1]
+		bit := int(f.ip[(f.bits-1)>>3]>>uint(7-(f.bits-1)&7)) & 1
+		w.err = formatError(ErrDatabaseError, w.db.dataOffset+parent*8+bit*4, parent,
+			"points back to node "+strconv.Itoa(f.node))
+		return false
+	}
+	w.onPath[f.node] = true
+	w.path = append(w.path, f.node)
+
+	return true
+}
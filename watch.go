@@ -0,0 +1,183 @@
+package ipdb
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// WatchOptions configures Watch
+type WatchOptions struct {
+	// Interval between two polls of the file, 10 seconds if zero
+	Interval time.Duration
+
+	// Debounce is how long the file has to stay unchanged before it is
+	// reloaded, so a file still being written is not picked up.
+	// One second if zero.
+	Debounce time.Duration
+
+	// OnChange is called after every reload attempt with the build time
+	// before and after it. If the reload failed, err is set and the
+	// previous database stays loaded. It runs on the polling goroutine,
+	// so it must not call Stop, which would wait for it forever.
+	OnChange func(old, new time.Time, err error)
+}
+
+// Watcher polls a database file, see Watch
+type Watcher struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Stop the watcher and wait for a running reload to finish.
+// It must not be called from OnChange.
+func (w *Watcher) Stop() {
+	w.halt()
+	<-w.done
+}
+
+// halt tells the watcher to stop without waiting for it
+func (w *Watcher) halt() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
+
+type fileState struct {
+	info os.FileInfo
+	sum  uint32
+}
+
+func (s fileState) sameStat(info os.FileInfo) bool {
+	return s.info != nil &&
+		os.SameFile(s.info, info) &&
+		s.info.Size() == info.Size() &&
+		s.info.ModTime().Equal(info.ModTime())
+}
+
+func fileChecksum(name string) (uint32, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// Watch polls the file at name and reloads the database when its
+// modification time, size or identity change, which covers files
+// replaced by rename. The file has to be stable for Debounce before it
+// is reloaded, and it is only reloaded if its checksum differs from the
+// loaded one. Call Stop on the returned Watcher to end polling;
+// closing the database ends it too.
+//
+// A database opened WithMmap must only be updated by renaming a new
+// file over name: rewriting it in place changes the mapped content
+// before the watcher sees the change.
+func (db *database) Watch(name string, opts WatchOptions) (*Watcher, error) {
+	if db.snapshot {
+		return nil, ErrSnapshotReload
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = time.Second
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileChecksum(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.current().closed {
+		return nil, ErrDatabaseClosed
+	}
+	if db.watchers == nil {
+		db.watchers = make(map[*Watcher]struct{})
+	}
+	db.watchers[w] = struct{}{}
+	go db.watch(w, name, opts, fileState{info: info, sum: sum})
+
+	return w, nil
+}
+
+func (db *database) watch(w *Watcher, name string, opts WatchOptions, loaded fileState) {
+	defer close(w.done)
+	defer func() {
+		db.mu.Lock()
+		delete(db.watchers, w)
+		db.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	var seen os.FileInfo
+	var changed time.Time
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			// the file may be between unlink and rename, try again later
+			continue
+		}
+		if loaded.sameStat(info) {
+			seen = nil
+			continue
+		}
+		if seen == nil || !(fileState{info: seen}).sameStat(info) {
+			seen = info
+			changed = time.Now()
+			continue
+		}
+		if time.Since(changed) < opts.Debounce {
+			continue
+		}
+
+		sum, err := fileChecksum(name)
+		if err != nil {
+			continue
+		}
+		seen = nil
+		if sum == loaded.sum {
+			// touched, but the content is the same
+			loaded.info = info
+			continue
+		}
+		// remember the attempt even if it fails, so a broken file is
+		// reported once and retried only after it changes again
+		loaded = fileState{info: info, sum: sum}
+
+		old := db.BuildTime()
+		err = db.Reload(name)
+		if opts.OnChange != nil {
+			opts.OnChange(old, db.BuildTime(), err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package ipdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type watchEvent struct {
+	old, new time.Time
+	err      error
+}
+
+func TestCityWatch(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+
+	cdb, err := NewCity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+
+	events := make(chan watchEvent, 4)
+	w, err := cdb.Watch(name, WatchOptions{
+		Interval: 5 * time.Millisecond,
+		Debounce: 20 * time.Millisecond,
+		OnChange: func(old, new time.Time, err error) {
+			events <- watchEvent{old, new, err}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	next := func() watchEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reload")
+		}
+		return watchEvent{}
+	}
+
+	// replace by rename
+	tmp := filepath.Join(dir, "city.ipdb.tmp")
+	writeFile(t, tmp, cityCopy(t, 2000))
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+	ev := next()
+	if ev.err != nil || ev.old.Unix() != 1000 || ev.new.Unix() != 2000 {
+		t.Fatalf("event = %+v, want 1000 -> 2000", ev)
+	}
+	if cdb.BuildTime().Unix() != 2000 {
+		t.Fatalf("BuildTime = %v", cdb.BuildTime())
+	}
+
+	// a broken file is reported and the loaded build kept
+	writeFile(t, name, []byte("broken"))
+	ev = next()
+	if ev.err == nil || ev.new.Unix() != 2000 {
+		t.Fatalf("event = %+v, want an error", ev)
+	}
+
+	// rewritten in place, which is fine as the file is not mapped
+	writeFile(t, name, cityCopy(t, 3000))
+	ev = next()
+	if ev.err != nil || ev.old.Unix() != 2000 || ev.new.Unix() != 3000 {
+		t.Fatalf("event = %+v, want 2000 -> 3000", ev)
+	}
+
+	// touching the file does not reload it
+	now := time.Now().Add(time.Minute)
+	if err := os.Chtimes(name, now, now); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected reload %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCityWatch_Close(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "city.ipdb")
+	writeFile(t, name, cityCopy(t, 1000))
+
+	cdb, err := NewCity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan watchEvent, 4)
+	w, err := cdb.Watch(name, WatchOptions{
+		Interval: 5 * time.Millisecond,
+		Debounce: 20 * time.Millisecond,
+		OnChange: func(old, new time.Time, err error) {
+			events <- watchEvent{old, new, err}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close ended the watcher, so Stop returns at once
+	w.Stop()
+
+	tmp := filepath.Join(dir, "city.ipdb.tmp")
+	writeFile(t, tmp, cityCopy(t, 2000))
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("reload after Close %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := cdb.Find("118.28.1.1", "CN"); err != ErrDatabaseClosed {
+		t.Fatalf("Find = %v, want ErrDatabaseClosed", err)
+	}
+	if err := cdb.Reload(name); err != ErrDatabaseClosed {
+		t.Fatalf("Reload = %v, want ErrDatabaseClosed", err)
+	}
+	if _, err := cdb.Find("118.28.1.1", "CN"); err != ErrDatabaseClosed {
+		t.Fatalf("Find after Reload = %v, want ErrDatabaseClosed", err)
+	}
+	if _, err := cdb.Watch(name, WatchOptions{}); err != ErrDatabaseClosed {
+		t.Fatalf("Watch = %v, want ErrDatabaseClosed", err)
+	}
+}